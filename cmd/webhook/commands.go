@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/spf13/pflag"
+)
+
+// commands maps subcommand names to their implementations. Each receives the
+// arguments following its name and returns the process exit code. When no
+// subcommand is given the webhook server is started.
+var commands = map[string]func(args []string) int{
+	"config":   runConfig,
+	"lint":     runLint,
+	"schema":   runSchema,
+	"validate": runValidate,
+}
+
+func runCommand(name string, args []string) int {
+	cmd, ok := commands[name]
+	if !ok {
+		names := make([]string, 0, len(commands))
+		for n := range commands {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(os.Stderr, "unknown command %q (available: %v)\n", name, names)
+		return 2
+	}
+	return cmd(args)
+}
+
+// newFlagSet returns a flag set for a subcommand that also accepts the global
+// flags. The global flags are shared rather than copied, so values parsed here
+// are visible through viper exactly as they are for the server.
+func newFlagSet(name string) *pflag.FlagSet {
+	fs := pflag.NewFlagSet(name, pflag.ContinueOnError)
+	fs.AddFlagSet(pflag.CommandLine)
+	return fs
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("runCommand", func() {
+	It("should reject unknown commands", func() {
+		code, _, stderr := runCaptured("no-such-command")
+		Expect(code).To(Equal(2))
+		Expect(stderr).To(ContainSubstring("unknown command"))
+	})
+})
+
+var _ = Describe("lint", func() {
+	const unanchored = "rules:\n  - namespace: default\n    patterns: [\"vm\"]\n"
+
+	It("should succeed without findings", func() {
+		code, stdout, _ := runCaptured("lint", writeFile("config.yaml", "rules:\n  - namespace: default\n    patterns: [\"^vm-\"]\n"))
+		Expect(code).To(Equal(0))
+		Expect(stdout).To(BeEmpty())
+	})
+
+	It("should fail on warnings by default", func() {
+		file := writeFile("config.yaml", unanchored)
+		code, stdout, _ := runCaptured("lint", file)
+		Expect(code).To(Equal(1))
+		Expect(stdout).To(HavePrefix(file + ":3:16: warning: rules[0].patterns[0]: "))
+	})
+
+	It("should only fail on errors with --fail-on error", func() {
+		code, _, _ := runCaptured("lint", "--fail-on", "error", writeFile("config.yaml", unanchored))
+		Expect(code).To(Equal(0))
+	})
+
+	It("should report findings in a ConfigMap at their position in the manifest", func() {
+		file := writeFile("cm.yaml", literalConfigMap)
+		code, stdout, _ := runCaptured("lint", "--output", "json", file)
+		Expect(code).To(Equal(1))
+		var results []lintResult
+		Expect(json.Unmarshal([]byte(stdout), &results)).To(Succeed())
+		Expect(results).NotTo(BeEmpty())
+		Expect(results[0].File).To(Equal(file))
+		Expect(results[0].Document).To(Equal("ConfigMap harvester-system/nested-virt"))
+		Expect(results[0].Line).To(BeNumerically(">", 7))
+	})
+
+	DescribeTable("should reject invalid flags",
+		func(args ...string) {
+			code, _, _ := runCaptured("lint", args...)
+			Expect(code).To(Equal(2))
+		},
+		Entry("output", "--output", "xml"),
+		Entry("fail-on", "--fail-on", "info"),
+	)
+})
+
+var _ = Describe("config", func() {
+	It("should require the dump subcommand", func() {
+		code, _, stderr := runCaptured("config")
+		Expect(code).To(Equal(2))
+		Expect(stderr).To(ContainSubstring("usage:"))
+	})
+
+	It("should dump the effective configuration", func() {
+		file := writeFile("config.yaml", "rules:\n  - namespace: default\n    patterns: [\"^vm-\"]\n")
+		code, stdout, _ := runCaptured("config", "dump", "--config", file, "--output", "json")
+		Expect(code).To(Equal(0))
+		Expect(stdout).To(ContainSubstring(`"namespace": "default"`))
+	})
+
+	It("should fail for an invalid configuration", func() {
+		code, _, stderr := runCaptured("config", "dump", "--config", writeFile("config.yaml", "rules: [{pattern: [x]}]\n"))
+		Expect(code).To(Equal(1))
+		Expect(stderr).To(ContainSubstring("config.yaml"))
+	})
+
+	It("should reject unknown output formats", func() {
+		file := writeFile("config.yaml", "rules: []\n")
+		code, _, _ := runCaptured("config", "dump", "--config", file, "--output", "xml")
+		Expect(code).To(Equal(2))
+	})
+})
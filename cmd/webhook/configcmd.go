@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/config"
+)
+
+// runConfig implements the "config" subcommand. Its only subcommand, "dump",
+// prints the effective configuration the server would run with, annotating
+// every value with where it came from.
+func runConfig(args []string) int {
+	if len(args) == 0 || args[0] != "dump" {
+		fmt.Fprintln(os.Stderr, "usage: webhook config dump [--output yaml|json] [flags]")
+		return 2
+	}
+
+	fs := newFlagSet("config dump")
+	output := fs.StringP("output", "o", "yaml", "Output format: yaml or json")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	configFile := viper.GetString("config")
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		var verrs config.ValidationErrors
+		if errors.As(err, &verrs) {
+			for _, verr := range verrs {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", configFile, verr)
+			}
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", configFile, err)
+		}
+		return 1
+	}
+
+	switch *output {
+	case "yaml":
+		enc := yaml.NewEncoder(os.Stdout)
+		enc.SetIndent(2)
+		err = enc.Encode(cfg.Effective())
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(cfg.Effective())
+	default:
+		fmt.Fprintf(os.Stderr, "invalid --output %q: must be yaml or json\n", *output)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to encode configuration: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/config"
+)
+
+// invalidCode is the finding code used by lint for problems that validate
+// would also report, so that lint output alone is enough for CI.
+const invalidCode = "invalid"
+
+// lintResult is a finding located in a file, and in the ConfigMap named by
+// Document if the file holds manifests
+type lintResult struct {
+	File     string `json:"file"`
+	Document string `json:"document,omitempty"`
+	config.Finding
+}
+
+// runLint implements the "lint" subcommand. It reports validation errors and
+// config.Lint findings for each file, in the same file formats as validate,
+// as text or as a JSON array for machine consumption.
+func runLint(args []string) int {
+	fs := newFlagSet("lint")
+	output := fs.StringP("output", "o", "text", "Output format: text or json")
+	failOn := fs.String("fail-on", string(config.SeverityWarning), "Exit non-zero for findings of this severity or worse: warning or error")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *output != "text" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "invalid --output %q: must be text or json\n", *output)
+		return 2
+	}
+	if *failOn != string(config.SeverityWarning) && *failOn != string(config.SeverityError) {
+		fmt.Fprintf(os.Stderr, "invalid --fail-on %q: must be warning or error\n", *failOn)
+		return 2
+	}
+
+	status := 0
+	results := []lintResult{}
+	for _, file := range inputFiles(fs) {
+		fileResults, err := lintFile(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+			status = 1
+			continue
+		}
+		results = append(results, fileResults...)
+	}
+
+	for _, r := range results {
+		if r.Severity == config.SeverityError || *failOn == string(config.SeverityWarning) {
+			status = 1
+		}
+	}
+
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to encode findings: %v\n", err)
+			return 1
+		}
+		return status
+	}
+	for _, r := range results {
+		fmt.Printf("%s: %s%s: %s: %s [%s]\n", location(r.File, r.Position), documentPrefix(r.Document), r.Severity, r.Field, r.Message, r.Code)
+	}
+	return status
+}
+
+func lintFile(file string) ([]lintResult, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := configDocuments(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []lintResult
+	for _, doc := range docs {
+		cfg, err := config.ParseConfig(doc.data)
+		var verrs config.ValidationErrors
+		if err != nil && !errors.As(err, &verrs) {
+			return nil, err
+		}
+		var docResults []lintResult
+		for _, verr := range verrs {
+			docResults = append(docResults, lintResult{File: file, Document: doc.name, Finding: config.Finding{
+				Severity: config.SeverityError,
+				Code:     invalidCode,
+				Field:    verr.Field,
+				Position: doc.position(verr.Position),
+				Message:  verr.Message,
+			}})
+		}
+		for _, finding := range config.Lint(cfg) {
+			finding.Position = doc.position(finding.Position)
+			docResults = append(docResults, lintResult{File: file, Document: doc.name, Finding: finding})
+		}
+		sort.SliceStable(docResults, func(i, j int) bool {
+			return docResults[i].Line < docResults[j].Line
+		})
+		results = append(results, docResults...)
+	}
+	return results, nil
+}
@@ -2,34 +2,69 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
-	"time"
 
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 
 	"github.com/jaevans/harvester-enable-nested-virt/pkg/config"
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/metrics"
 	"github.com/jaevans/harvester-enable-nested-virt/pkg/mutation"
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/tracing"
 	"github.com/jaevans/harvester-enable-nested-virt/pkg/webhook"
 
 	"log/slog"
 )
 
+// Build information, set with -ldflags by the release build
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+)
+
 func init() {
-	pflag.String("config", "/etc/webhook/config.yaml", "Path to the configuration file")
-	pflag.Int("port", 8443, "Webhook server port")
-	pflag.String("cert-dir", "/etc/webhook/certs", "The directory containing TLS certificates (overrides CERT_DIR env var)")
+	pflag.String("config", config.DefaultConfigFile, "Path to the configuration file")
+	pflag.Int("port", config.DefaultPort, "Webhook server port")
+	pflag.String("cert-dir", config.DefaultCertDir, "The directory containing TLS certificates (overrides CERT_DIR env var)")
+	pflag.Duration("cert-wait-timeout", config.DefaultCertWaitTimeout, "How long to wait at startup for the TLS certificate to appear in cert-dir")
+	pflag.Duration("cert-expiry-threshold", config.DefaultCertExpiryThreshold, "How long before the TLS certificate expires that /readyz starts failing")
+	pflag.Duration("drain-period", config.DefaultDrainPeriod, "How long to keep serving after SIGTERM while failing readiness (0 to skip)")
+	pflag.Duration("shutdown-timeout", config.DefaultShutdownTimeout, "How long requests in flight get to complete once draining is over")
+	pflag.Int64("max-request-bytes", config.DefaultMaxRequestBytes, "Largest admission review request body accepted, in bytes")
+	pflag.Int("max-in-flight", 0, "Most admission requests handled at once (default: no limit)")
+	pflag.Int("max-queue", 0, "Most admission requests waiting for a slot once max-in-flight is reached")
+	pflag.Duration("max-queue-wait", config.DefaultMaxQueueWait, "Longest a request waits for a slot, capped at half the API server's timeout")
+	pflag.String("shed-policy", config.OnErrorAllowWithWarning, "What happens to a VM whose request is shed: allow, allow-with-warning or deny")
+	pflag.String("client-ca-file", "", "CA bundle that client certificates for /mutate must be signed by")
+	pflag.StringSlice("allowed-client-subjects", nil, "Common names of the client certificates accepted by /mutate")
+	pflag.String("bind-address", "", "IPv4 or IPv6 address to listen on (default: all interfaces)")
+	pflag.String("tls-min-version", config.TLSVersion12, "Oldest TLS version accepted: 1.2 or 1.3")
+	pflag.StringSlice("tls-cipher-suites", nil, "TLS 1.2 cipher suites accepted, by IANA name")
+	pflag.StringSlice("tls-curve-preferences", nil, "Key exchange curves in order of preference")
+	pflag.Duration("read-header-timeout", config.DefaultReadHeaderTimeout, "How long to wait for request headers")
+	pflag.Duration("read-timeout", config.DefaultReadTimeout, "How long to wait for a whole request")
+	pflag.Duration("write-timeout", config.DefaultWriteTimeout, "How long writing a response may take")
+	pflag.Duration("idle-timeout", 0, "How long to keep idle connections open (default: read-timeout)")
+	pflag.Int("metrics-port", 0, "Port serving /metrics over plain HTTP (default: served on the webhook port over TLS)")
+	pflag.String("tracing-endpoint", "", "OTLP/HTTP endpoint admission request traces are exported to, e.g. http://otel-collector:4318 (default: tracing is off)")
+	pflag.Float64("tracing-sample-ratio", config.DefaultTracingSampleRatio, "Fraction of admission requests traced that are not already sampled by the API server")
 	pflag.Bool("debug", false, "Enable debug logging")
+	pflag.String("on-error", config.OnErrorAllow, "What happens to a VM when the webhook fails to handle it: allow, allow-with-warning or deny")
+	pflag.String("mode", config.ModeEnforce, "Whether patches are returned (enforce) or only reported (shadow)")
+	pflag.String("label", "", "Label added to every VM the webhook mutates, as key=value (e.g. nested-virt.jaevans.io/enabled=true)")
 	err := viper.BindPFlags(pflag.CommandLine)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to bind command line flags: %v\n", err)
 		os.Exit(1)
 	}
-	viper.SetEnvPrefix("nested_virt")
+	viper.SetEnvPrefix(config.EnvPrefix)
 	// Allow environment variables like NESTED_VIRT_CERT_DIR to map to key "cert-dir"
 	// Hyphens are replaced with underscores for env var compatibility
 	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
@@ -37,18 +72,20 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
 	pflag.Parse()
+
 	configFile := viper.GetString("config")
 
-	cfg, err := config.LoadConfig(configFile)
+	cfg, err := loadConfig(configFile)
+	metrics.RecordConfigLoad(err)
 	if err != nil {
-		slog.Error("Failed to load configuration", "error", err)
+		slog.Error("Failed to load configuration", "file", configFile, "error", err)
 		os.Exit(1)
 	}
 
-	// Merge environment variables and CLI flag overrides with correct precedence.
-	cfg = config.MergeWithOverrides(viper.GetViper(), cfg)
-
 	// Set up logging
 	var logLevel slog.Level
 	if cfg.Debug {
@@ -63,7 +100,20 @@ func main() {
 	certFile := fmt.Sprintf("%s/tls.crt", cfg.CertDir)
 	keyFile := fmt.Sprintf("%s/tls.key", cfg.CertDir)
 
+	logger.Info("Starting nested virtualization webhook", "version", version, "commit", commit, "date", date)
 	logger.Info("Loaded configuration", "rules_count", len(cfg.Rules))
+	webhook.Version = version
+
+	// Set up tracing
+	stopTracing := func(context.Context) error { return nil }
+	if cfg.TracingEndpoint != "" {
+		stopTracing, err = tracing.Setup(context.Background(), cfg.TracingEndpoint, cfg.TracingSampleRatio, version)
+		if err != nil {
+			logger.Error("Failed to set up tracing", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("Tracing admission requests", "endpoint", cfg.TracingEndpoint, "sampleRatio", cfg.TracingSampleRatio)
+	}
 
 	// Create mutator
 	mutator := mutation.NewVMFeatureMutator(nil)
@@ -73,17 +123,31 @@ func main() {
 
 	// Create server
 	serverCfg := webhook.ServerConfig{
-		Port:     cfg.Port,
-		CertFile: certFile,
-		KeyFile:  keyFile,
+		BindAddress:           cfg.BindAddress,
+		Port:                  cfg.Port,
+		MinTLSVersion:         cfg.MinTLSVersion(),
+		CipherSuites:          cfg.CipherSuiteIDs(),
+		CurvePreferences:      cfg.CurveIDs(),
+		ReadHeaderTimeout:     cfg.ReadHeaderTimeout,
+		ReadTimeout:           cfg.ReadTimeout,
+		WriteTimeout:          cfg.WriteTimeout,
+		IdleTimeout:           cfg.IdleTimeout,
+		CertFile:              certFile,
+		KeyFile:               keyFile,
+		CertWaitTimeout:       cfg.CertWaitTimeout,
+		CertExpiryThreshold:   cfg.CertExpiryThreshold,
+		EnableDebug:           cfg.Debug,
+		MetricsPort:           cfg.MetricsPort,
+		ClientCAFile:          cfg.ClientCAFile,
+		AllowedClientSubjects: cfg.AllowedClientSubjects,
 	}
 	server := webhook.NewServer(serverCfg, handler)
 
 	// Start server in a goroutine
 	go func() {
-		fmt.Printf("Starting webhook server on port %d\n", cfg.Port)
-		if err := server.Start(certFile, keyFile); err != nil {
-			fmt.Fprintf(os.Stderr, "Server error: %v\n", err)
+		logger.Info("Starting webhook server", "address", cfg.BindAddress, "port", cfg.Port, "tlsMinVersion", cfg.TLSMinVersion)
+		if err := server.Start(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Server error", "error", err)
 			os.Exit(1)
 		}
 	}()
@@ -91,16 +155,43 @@ func main() {
 	// Wait for interrupt signal
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	sig := <-sigChan
 
-	fmt.Println("Shutting down webhook server...")
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	// Keep serving requests the API server has already routed here until
+	// it stops sending new ones; a second signal skips the wait
+	logger.Info("Draining webhook server", "signal", sig.String(), "drainPeriod", cfg.DrainPeriod)
+	drainCtx, stopDrain := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	server.Drain(drainCtx, cfg.DrainPeriod)
+	stopDrain()
+
+	logger.Info("Shutting down webhook server", "timeout", cfg.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
 	defer cancel()
 
 	if err := server.Shutdown(ctx); err != nil {
-		fmt.Fprintf(os.Stderr, "Error during shutdown: %v\n", err)
+		logger.Error("Error during shutdown", "error", err)
 		os.Exit(1)
 	}
+	if err := stopTracing(ctx); err != nil {
+		logger.Warn("Failed to export the remaining traces", "error", err)
+	}
+
+	logger.Info("Webhook server stopped")
+}
+
+// loadConfig loads the configuration file and layers the environment, flags
+// and defaults over it, in that order of increasing precedence for all but
+// the defaults, which only fill in what is left unset.
+func loadConfig(configFile string) (*config.Config, error) {
+	cfg, err := config.LoadConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
 
-	fmt.Println("Webhook server stopped")
+	// Merge environment variables and CLI flag overrides with correct precedence.
+	cfg = config.ApplyDefaults(config.MergeWithOverrides(viper.GetViper(), cfg))
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
 }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestWebhookCommand(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Webhook Command Suite")
+}
+
+// runCaptured runs a subcommand and returns its exit code along with what it
+// printed to stdout and stderr
+func runCaptured(name string, args ...string) (int, string, string) {
+	stdout, stderr := os.Stdout, os.Stderr
+	outFile, err := os.CreateTemp(GinkgoT().TempDir(), "stdout")
+	Expect(err).NotTo(HaveOccurred())
+	errFile, err := os.CreateTemp(GinkgoT().TempDir(), "stderr")
+	Expect(err).NotTo(HaveOccurred())
+	os.Stdout, os.Stderr = outFile, errFile
+	defer func() { os.Stdout, os.Stderr = stdout, stderr }()
+
+	code := runCommand(name, args)
+
+	read := func(f *os.File) string {
+		_, err := f.Seek(0, io.SeekStart)
+		Expect(err).NotTo(HaveOccurred())
+		data, err := io.ReadAll(f)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+		return string(data)
+	}
+	return code, read(outFile), read(errFile)
+}
+
+// writeFile writes content to a file in a temporary directory and returns
+// its path
+func writeFile(name, content string) string {
+	path := filepath.Join(GinkgoT().TempDir(), name)
+	Expect(os.WriteFile(path, []byte(content), 0o600)).To(Succeed())
+	return path
+}
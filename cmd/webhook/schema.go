@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/config"
+)
+
+// runSchema implements the "schema" subcommand, which prints the JSON Schema
+// for the configuration file. The published copy lives in
+// docs/config.schema.json and is regenerated with "make schema".
+func runSchema(args []string) int {
+	fs := newFlagSet("schema")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	schema, err := config.JSONSchema()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to generate schema: %v\n", err)
+		return 1
+	}
+	if _, err := os.Stdout.Write(schema); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write schema: %v\n", err)
+		return 1
+	}
+	return 0
+}
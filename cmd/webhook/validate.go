@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/config"
+)
+
+// runValidate implements the "validate" subcommand. It strictly parses each
+// file named on the command line, or the --config file when none are given,
+// runs the tests embedded in it, and prints every problem found. Files may
+// hold plain webhook configuration or ConfigMap manifests with a config.yaml
+// key, so rendered Helm output can be checked directly.
+func runValidate(args []string) int {
+	fs := newFlagSet("validate")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	status := 0
+	for _, file := range inputFiles(fs) {
+		if !validateFile(file) {
+			status = 1
+		}
+	}
+	return status
+}
+
+func validateFile(file string) bool {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+		return false
+	}
+
+	docs, err := configDocuments(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+		return false
+	}
+
+	valid := true
+	for _, doc := range docs {
+		cfg, err := config.ParseConfig(doc.data)
+		if err == nil {
+			if len(cfg.Tests) > 0 {
+				fmt.Printf("%s: %sOK (tests: %d passed)\n", file, documentPrefix(doc.name), len(cfg.Tests))
+			} else {
+				fmt.Printf("%s: %sOK\n", file, documentPrefix(doc.name))
+			}
+			continue
+		}
+		valid = false
+		var verrs config.ValidationErrors
+		if !errors.As(err, &verrs) {
+			fmt.Fprintf(os.Stderr, "%s: %s%v\n", file, documentPrefix(doc.name), err)
+			continue
+		}
+		for _, verr := range verrs {
+			fmt.Fprintln(os.Stderr, doc.format(file, verr))
+		}
+	}
+	return valid
+}
+
+// inputFiles returns the files named on the command line, or the --config
+// file when none are given.
+func inputFiles(fs *pflag.FlagSet) []string {
+	if fs.NArg() > 0 {
+		return fs.Args()
+	}
+	return []string{viper.GetString("config")}
+}
+
+// configDocument is a webhook configuration found in a file, along with the
+// offsets that map positions inside it back to positions in the file.
+type configDocument struct {
+	// name identifies the ConfigMap the document came from, if any
+	name   string
+	data   []byte
+	line   int
+	column int
+}
+
+// documentPrefix returns "(name) ", to start messages about the document
+// with that name, or nothing for a plain config file.
+func documentPrefix(name string) string {
+	if name == "" {
+		return ""
+	}
+	return "(" + name + ") "
+}
+
+// position maps a position inside the document to a position in its file
+func (d configDocument) position(pos config.Position) config.Position {
+	if pos.Line == 0 {
+		return pos
+	}
+	pos.Line += d.line
+	if pos.Column > 0 {
+		pos.Column += d.column
+	}
+	return pos
+}
+
+// location renders pos in file as "file:line:column", the form most editors
+// and CI annotators recognise.
+func location(file string, pos config.Position) string {
+	if pos.Line == 0 {
+		return file
+	}
+	if pos.Column == 0 {
+		return fmt.Sprintf("%s:%d", file, pos.Line)
+	}
+	return fmt.Sprintf("%s:%d:%d", file, pos.Line, pos.Column)
+}
+
+// format renders verr as "file:line:column: (ConfigMap namespace/name)
+// field: message", leaving out the parts that are unknown.
+func (d configDocument) format(file string, verr config.ValidationError) string {
+	message := verr.Message
+	if verr.Field != "" {
+		message = verr.Field + ": " + message
+	}
+	return fmt.Sprintf("%s: %s%s", location(file, d.position(verr.Position)), documentPrefix(d.name), message)
+}
+
+// configDocuments extracts the config.yaml key from every ConfigMap in data.
+// If data holds no Kubernetes manifests it is treated as a single plain config.
+func configDocuments(data []byte) ([]configDocument, error) {
+	lines := strings.Split(string(data), "\n")
+	var docs []configDocument
+	manifests := false
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var node yaml.Node
+		err := dec.Decode(&node)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// Let ParseConfig report the syntax error with its position
+			return []configDocument{{data: data}}, nil
+		}
+		if len(node.Content) == 0 {
+			continue
+		}
+		kind := mappingValue(node.Content[0], "kind").Value
+		manifests = manifests || kind != ""
+		if kind != "ConfigMap" {
+			continue
+		}
+		value := mappingValue(mappingValue(node.Content[0], "data"), "config.yaml")
+		if value.Kind != yaml.ScalarNode {
+			continue
+		}
+
+		metadata := mappingValue(node.Content[0], "metadata")
+		doc := configDocument{
+			name: fmt.Sprintf("ConfigMap %s/%s",
+				mappingValue(metadata, "namespace").Value, mappingValue(metadata, "name").Value),
+			data: []byte(value.Value),
+		}
+		// Block scalars start on the line after the indicator, so positions
+		// can be mapped back exactly. Other styles are reported relative to
+		// the start of the embedded document.
+		if value.Style == yaml.LiteralStyle || value.Style == yaml.FoldedStyle {
+			doc.line = value.Line
+			doc.column = blockIndent(lines, value.Line)
+		}
+		docs = append(docs, doc)
+	}
+
+	if len(docs) == 0 {
+		if manifests {
+			return nil, errors.New("no ConfigMap with a config.yaml key found")
+		}
+		return []configDocument{{data: data}}, nil
+	}
+	return docs, nil
+}
+
+// mappingValue returns the value for key in a mapping node, or an empty node
+// if node is not a mapping or has no such key.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				return node.Content[i+1]
+			}
+		}
+	}
+	return &yaml.Node{}
+}
+
+// blockIndent returns the indentation of the first non-blank line after the
+// 0-based line index start, which is the indentation of a block scalar whose
+// indicator is on the 1-based line start.
+func blockIndent(lines []string, start int) int {
+	for _, line := range lines[min(start, len(lines)):] {
+		if strings.TrimSpace(line) != "" {
+			return len(line) - len(strings.TrimLeft(line, " "))
+		}
+	}
+	return 0
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/config"
+)
+
+const literalConfigMap = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: nested-virt
+  namespace: harvester-system
+data:
+  config.yaml: |
+    rules:
+      - namespace: default
+        pattern: ["x"]
+`
+
+const flowConfigMap = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: nested-virt
+  namespace: harvester-system
+data:
+  config.yaml: "rules: [{namespace: default, pattern: [x]}]"
+`
+
+var _ = Describe("configDocuments", func() {
+	DescribeTable("should find the webhook configurations in a file",
+		func(data string, expected []configDocument) {
+			docs, err := configDocuments([]byte(data))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(docs).To(Equal(expected))
+		},
+		Entry("plain config", "rules: []\n", []configDocument{{data: []byte("rules: []\n")}}),
+		Entry("literal block scalar", literalConfigMap, []configDocument{{
+			name:   "ConfigMap harvester-system/nested-virt",
+			data:   []byte("rules:\n  - namespace: default\n    pattern: [\"x\"]\n"),
+			line:   7,
+			column: 4,
+		}}),
+		Entry("folded block scalar", "kind: ConfigMap\ndata:\n  config.yaml: >\n      debug: true\n", []configDocument{{
+			name:   "ConfigMap /",
+			data:   []byte("debug: true\n"),
+			line:   3,
+			column: 6,
+		}}),
+		Entry("flow scalar", flowConfigMap, []configDocument{{
+			name: "ConfigMap harvester-system/nested-virt",
+			data: []byte("rules: [{namespace: default, pattern: [x]}]"),
+		}}),
+		Entry("several manifests", "kind: Service\n---\n"+literalConfigMap+"---\n"+flowConfigMap, []configDocument{
+			{
+				name:   "ConfigMap harvester-system/nested-virt",
+				data:   []byte("rules:\n  - namespace: default\n    pattern: [\"x\"]\n"),
+				line:   9,
+				column: 4,
+			},
+			{
+				name: "ConfigMap harvester-system/nested-virt",
+				data: []byte("rules: [{namespace: default, pattern: [x]}]"),
+			},
+		}),
+		Entry("invalid YAML, left for ParseConfig to report", "rules: [\n", []configDocument{{data: []byte("rules: [\n")}}),
+	)
+
+	DescribeTable("should reject manifests without a config.yaml key",
+		func(data string) {
+			_, err := configDocuments([]byte(data))
+			Expect(err).To(MatchError(ContainSubstring("no ConfigMap with a config.yaml key found")))
+		},
+		Entry("no ConfigMap", "kind: Deployment\nmetadata:\n  name: webhook\n"),
+		Entry("ConfigMap with other keys", "kind: ConfigMap\ndata:\n  other.yaml: |\n    debug: true\n"),
+	)
+
+	DescribeTable("should map positions in a document to positions in its file",
+		func(doc configDocument, pos, expected config.Position) {
+			Expect(doc.position(pos)).To(Equal(expected))
+		},
+		Entry("plain config", configDocument{}, config.Position{Line: 3, Column: 5}, config.Position{Line: 3, Column: 5}),
+		Entry("block scalar", configDocument{line: 7, column: 4}, config.Position{Line: 3, Column: 5}, config.Position{Line: 10, Column: 9}),
+		Entry("no position", configDocument{line: 7, column: 4}, config.Position{}, config.Position{}),
+		Entry("no column", configDocument{line: 7, column: 4}, config.Position{Line: 3}, config.Position{Line: 10}),
+	)
+
+	DescribeTable("should render locations as file:line:column",
+		func(pos config.Position, expected string) {
+			Expect(location("cm.yaml", pos)).To(Equal(expected))
+		},
+		Entry("line and column", config.Position{Line: 10, Column: 9}, "cm.yaml:10:9"),
+		Entry("line only", config.Position{Line: 10}, "cm.yaml:10"),
+		Entry("no position", config.Position{}, "cm.yaml"),
+	)
+})
+
+var _ = Describe("validate", func() {
+	It("should accept a valid file", func() {
+		code, stdout, _ := runCaptured("validate", writeFile("config.yaml", "rules:\n  - namespace: default\n    patterns: [\"^vm-\"]\n"))
+		Expect(code).To(Equal(0))
+		Expect(stdout).To(HaveSuffix("config.yaml: OK\n"))
+	})
+
+	It("should report problems in a ConfigMap at their position in the manifest", func() {
+		file := writeFile("cm.yaml", literalConfigMap)
+		code, _, stderr := runCaptured("validate", file)
+		Expect(code).To(Equal(1))
+		Expect(stderr).To(Equal(file + `:10:9: (ConfigMap harvester-system/nested-virt) rules[0].pattern: unknown field "pattern"` + "\n"))
+	})
+
+	It("should fail for a file that cannot be read", func() {
+		code, _, stderr := runCaptured("validate", filepath.Join(GinkgoT().TempDir(), "missing.yaml"))
+		Expect(code).To(Equal(1))
+		Expect(stderr).To(ContainSubstring("missing.yaml"))
+	})
+
+	It("should fail for manifests without a config", func() {
+		code, _, _ := runCaptured("validate", writeFile("deploy.yaml", "kind: Deployment\n"))
+		Expect(code).To(Equal(1))
+	})
+
+	It("should reject unknown flags", func() {
+		code, _, _ := runCaptured("validate", "--no-such-flag")
+		Expect(code).To(Equal(2))
+	})
+})
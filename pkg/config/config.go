@@ -1,13 +1,17 @@
 package config
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"regexp"
+	"strings"
+	"time"
 
 	"log/slog"
 
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
-	"gopkg.in/yaml.v3"
 )
 
 // NamespaceRule represents a namespace with its associated VM name patterns
@@ -16,25 +20,114 @@ type NamespaceRule struct {
 	Patterns  []*regexp.Regexp
 }
 
+// NamespaceRuleConfig is a rule as written in the configuration file. The
+// description and enum tags are used by JSONSchema.
 type NamespaceRuleConfig struct {
-	Namespace string   `yaml:"namespace"`
-	Patterns  []string `yaml:"patterns"`
+	// Name identifies the rule in warnings and logs; see Config.RuleName
+	Name      string   `yaml:"name,omitempty" description:"Name identifying the rule in warnings and logs (default rules[N])"`
+	Namespace string   `yaml:"namespace" description:"Namespace the rule applies to"`
+	Patterns  []string `yaml:"patterns,omitempty" description:"Regular expressions (RE2 syntax) matched against VM names"`
+	// OnError overrides Config.OnError for VMs selected by this rule
+	OnError string `yaml:"on-error,omitempty" description:"What happens to a VM selected by this rule when the webhook fails to handle it; overrides the global on-error" enum:"allow,allow-with-warning,deny"`
+	// Mode overrides Config.Mode for VMs selected by this rule
+	Mode string `yaml:"mode,omitempty" description:"Whether patches for VMs selected by this rule are returned (enforce) or only reported (shadow); overrides the global mode" enum:"enforce,shadow"`
 }
 
+// Policies for on-error: what happens to a VM when the webhook fails to
+// detect the CPU feature, decode the VM or build a patch. This is separate
+// from the failurePolicy of the MutatingWebhookConfiguration, which only
+// applies when the webhook cannot be reached.
+const (
+	// OnErrorAllow admits the VM unchanged
+	OnErrorAllow = "allow"
+	// OnErrorAllowWithWarning admits the VM unchanged and returns a warning
+	// to the client
+	OnErrorAllowWithWarning = "allow-with-warning"
+	// OnErrorDeny rejects the VM
+	OnErrorDeny = "deny"
+)
+
+// Modes: whether the webhook returns the patches it builds. Shadow mode is
+// for trying out rules; everything is evaluated, logged and counted as usual
+// but VMs are admitted unchanged.
+const (
+	// ModeEnforce returns patches
+	ModeEnforce = "enforce"
+	// ModeShadow only reports the patches that would have been returned
+	ModeShadow = "shadow"
+)
+
 // Config holds the configuration for the webhook
 type Config struct {
 	// Server configuration
-	Port    int    `yaml:"port,omitempty"`
-	CertDir string `yaml:"cert-dir,omitempty"`
+	Port int `yaml:"port,omitempty" description:"Port the webhook server listens on"`
+	// BindAddress is the IP address the servers listen on
+	BindAddress string `yaml:"bind-address,omitempty" description:"IPv4 or IPv6 address the webhook and metrics servers listen on (default: all interfaces)"`
+	CertDir     string `yaml:"cert-dir,omitempty" description:"Directory containing tls.crt and tls.key"`
+	// CertWaitTimeout is how long to wait at startup for the certificate
+	CertWaitTimeout time.Duration `yaml:"cert-wait-timeout,omitempty" description:"How long to wait at startup for tls.crt and tls.key to appear in cert-dir, e.g. 2m (default 2m)"`
+	// CertExpiryThreshold is how long before the certificate expires that
+	// the webhook stops reporting ready
+	CertExpiryThreshold time.Duration `yaml:"cert-expiry-threshold,omitempty" description:"How long before the certificate expires that /readyz starts failing, e.g. 24h (default 24h)"`
+	// DrainPeriod and ShutdownTimeout control graceful shutdown
+	DrainPeriod     time.Duration `yaml:"drain-period,omitempty" description:"How long to keep serving after a shutdown signal while failing readiness, e.g. 5s (default 5s); 0s shuts down without draining"`
+	ShutdownTimeout time.Duration `yaml:"shutdown-timeout,omitempty" description:"How long requests in flight get to complete once draining is over, e.g. 20s (default 20s)"`
+	// TLS policy
+	TLSMinVersion       string   `yaml:"tls-min-version,omitempty" description:"Oldest TLS version accepted (default 1.2)" enum:"1.2,1.3"`
+	TLSCipherSuites     []string `yaml:"tls-cipher-suites,omitempty" description:"TLS 1.2 cipher suites accepted, by IANA name, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 (default: Go's secure suites)"`
+	TLSCurvePreferences []string `yaml:"tls-curve-preferences,omitempty" description:"Key exchange curves in order of preference: X25519, P-256, P-384, P-521 or X25519MLKEM768 (default: Go's defaults)"`
+	// HTTP server timeouts
+	ReadHeaderTimeout time.Duration `yaml:"read-header-timeout,omitempty" description:"How long to wait for request headers, e.g. 10s (default 10s)"`
+	ReadTimeout       time.Duration `yaml:"read-timeout,omitempty" description:"How long to wait for a whole request, e.g. 30s (default 30s)"`
+	WriteTimeout      time.Duration `yaml:"write-timeout,omitempty" description:"How long writing a response may take, e.g. 30s (default 30s)"`
+	IdleTimeout       time.Duration `yaml:"idle-timeout,omitempty" description:"How long to keep idle connections open, e.g. 2m (default: read-timeout)"`
+	// MaxRequestBytes limits the size of admission review request bodies
+	MaxRequestBytes int64 `yaml:"max-request-bytes,omitempty" description:"Largest admission review request body accepted, in bytes (default 4194304)"`
+	// Load shedding: at most MaxInFlight requests are handled at once, and
+	// up to MaxQueue more wait up to MaxQueueWait for a slot. Requests that
+	// do not get one are answered according to ShedPolicy.
+	MaxInFlight  int           `yaml:"max-in-flight,omitempty" description:"Most admission requests handled at once (default: no limit)"`
+	MaxQueue     int           `yaml:"max-queue,omitempty" description:"Most admission requests waiting for a slot once max-in-flight is reached (default 0: shed at once)"`
+	MaxQueueWait time.Duration `yaml:"max-queue-wait,omitempty" description:"Longest a request waits for a slot, capped at half the timeout the API server gives the webhook, e.g. 2s (default 2s); 0s sheds requests that find no free slot at once"`
+	ShedPolicy   string        `yaml:"shed-policy,omitempty" description:"What happens to a VM whose request is shed (default allow-with-warning)" enum:"allow,allow-with-warning,deny"`
+	// ClientCAFile enables client certificate verification for the admission
+	// endpoint; AllowedClientSubjects restricts which clients are accepted
+	ClientCAFile          string   `yaml:"client-ca-file,omitempty" description:"CA bundle that client certificates for /mutate must be signed by; when set, requests without a valid client certificate are rejected"`
+	AllowedClientSubjects []string `yaml:"allowed-client-subjects,omitempty" description:"Common names of the client certificates accepted by /mutate (default: any certificate signed by client-ca-file)"`
+	// MetricsPort serves /metrics over plain HTTP on a port of its own
+	MetricsPort int `yaml:"metrics-port,omitempty" description:"Port serving /metrics over plain HTTP (default: /metrics is served on the webhook port over TLS)"`
+	// TracingEndpoint enables OpenTelemetry tracing of admission requests,
+	// exporting a TracingSampleRatio fraction of them over OTLP/HTTP
+	TracingEndpoint    string  `yaml:"tracing-endpoint,omitempty" description:"OTLP/HTTP endpoint admission request traces are exported to, e.g. http://otel-collector:4318 (default: tracing is off)"`
+	TracingSampleRatio float64 `yaml:"tracing-sample-ratio,omitempty" description:"Fraction of admission requests traced that are not already sampled by the API server, between 0 and 1 (default 1); 0 only traces requests the API server samples"`
 
 	// Logging
-	Debug bool `yaml:"debug,omitempty"`
+	Debug bool `yaml:"debug,omitempty" description:"Enable debug logging"`
+
+	// Admission behaviour
+	OnError string `yaml:"on-error,omitempty" description:"What happens to a VM when the webhook fails to handle it (default allow)" enum:"allow,allow-with-warning,deny"`
+	Mode    string `yaml:"mode,omitempty" description:"Whether patches are returned (enforce) or only reported (shadow) (default enforce)" enum:"enforce,shadow"`
+
+	// Label added to mutated VMs, as key=value
+	Label string `yaml:"label,omitempty" description:"Label added to every VM the webhook mutates, as key=value, e.g. nested-virt.jaevans.io/enabled=true"`
+
+	// Messages returned to clients as admission warnings
+	Warnings *WarningsConfig `yaml:"warnings,omitempty" description:"Admission warnings returned to clients"`
 
 	// VM matching rules
-	Rules []NamespaceRuleConfig `yaml:"rules,omitempty"`
+	Rules []NamespaceRuleConfig `yaml:"rules,omitempty" description:"Rules selecting the VMs that get nested virtualization"`
+
+	// Expectations checked against Rules whenever the config is parsed
+	Tests []RuleTest `yaml:"tests,omitempty" description:"Expectations checked against the rules whenever the configuration is loaded"`
 
 	// parsedRules holds the compiled regex patterns for efficient matching
 	parsedRules []NamespaceRule
+
+	// positions records where each field was found when parsed from YAML
+	positions map[string]Position
+
+	// sources records where each top-level setting was last set from
+	sources map[string]Source
 }
 
 func (c *Config) GetParsedRules() []NamespaceRule {
@@ -61,54 +154,313 @@ func (c *Config) GetParsedRules() []NamespaceRule {
 	return c.parsedRules
 }
 
+// Defaults applied by ApplyDefaults to settings that are not configured anywhere
+const (
+	DefaultConfigFile = "/etc/webhook/config.yaml"
+	DefaultPort       = 8443
+	DefaultCertDir    = "/etc/webhook/certs"
+
+	DefaultCertWaitTimeout     = 2 * time.Minute
+	DefaultCertExpiryThreshold = 24 * time.Hour
+	DefaultReadHeaderTimeout   = 10 * time.Second
+	DefaultReadTimeout         = 30 * time.Second
+	DefaultWriteTimeout        = 30 * time.Second
+	DefaultMaxRequestBytes     = 4 << 20
+	DefaultMaxQueueWait        = 2 * time.Second
+	DefaultDrainPeriod         = 5 * time.Second
+	DefaultShutdownTimeout     = 20 * time.Second
+	DefaultTracingSampleRatio  = 1.0
+)
+
+// EnvPrefix is the prefix of environment variables that override settings,
+// e.g. NESTED_VIRT_CERT_DIR for "cert-dir"
+const EnvPrefix = "NESTED_VIRT"
+
+// LoadConfig reads and strictly parses the configuration file at configFile.
+// See ParseConfig for the checks that are applied and for what is returned
+// alongside an error.
 func LoadConfig(configFile string) (*Config, error) {
-	cfg := Config{}
 	data, err := os.ReadFile(configFile)
 	if err != nil {
 		return nil, err
 	}
-	err = yaml.Unmarshal(data, &cfg)
-	return &cfg, err
+	cfg, err := ParseConfig(data)
+	if cfg != nil {
+		for field := range cfg.positions {
+			if field != "" && !strings.ContainsAny(field, ".[") {
+				cfg.setSource(field, Source{Kind: SourceFile, Name: configFile})
+			}
+		}
+	}
+	return cfg, err
+}
+
+// overrides lists the settings that can be set through the environment and
+// command line flags, keyed by their YAML name, which is also the flag name.
+var overrides = []struct {
+	key   string
+	apply func(v *viper.Viper, cfg *Config)
+}{
+	{"port", func(v *viper.Viper, cfg *Config) { cfg.Port = v.GetInt("port") }},
+	{"bind-address", func(v *viper.Viper, cfg *Config) { cfg.BindAddress = v.GetString("bind-address") }},
+	{"cert-dir", func(v *viper.Viper, cfg *Config) { cfg.CertDir = v.GetString("cert-dir") }},
+	{"cert-wait-timeout", func(v *viper.Viper, cfg *Config) { cfg.CertWaitTimeout = v.GetDuration("cert-wait-timeout") }},
+	{"cert-expiry-threshold", func(v *viper.Viper, cfg *Config) { cfg.CertExpiryThreshold = v.GetDuration("cert-expiry-threshold") }},
+	{"drain-period", func(v *viper.Viper, cfg *Config) { cfg.DrainPeriod = v.GetDuration("drain-period") }},
+	{"shutdown-timeout", func(v *viper.Viper, cfg *Config) { cfg.ShutdownTimeout = v.GetDuration("shutdown-timeout") }},
+	{"tls-min-version", func(v *viper.Viper, cfg *Config) { cfg.TLSMinVersion = v.GetString("tls-min-version") }},
+	{"tls-cipher-suites", func(v *viper.Viper, cfg *Config) {
+		cfg.TLSCipherSuites = splitList(v.GetStringSlice("tls-cipher-suites"))
+	}},
+	{"tls-curve-preferences", func(v *viper.Viper, cfg *Config) {
+		cfg.TLSCurvePreferences = splitList(v.GetStringSlice("tls-curve-preferences"))
+	}},
+	{"read-header-timeout", func(v *viper.Viper, cfg *Config) { cfg.ReadHeaderTimeout = v.GetDuration("read-header-timeout") }},
+	{"read-timeout", func(v *viper.Viper, cfg *Config) { cfg.ReadTimeout = v.GetDuration("read-timeout") }},
+	{"write-timeout", func(v *viper.Viper, cfg *Config) { cfg.WriteTimeout = v.GetDuration("write-timeout") }},
+	{"idle-timeout", func(v *viper.Viper, cfg *Config) { cfg.IdleTimeout = v.GetDuration("idle-timeout") }},
+	{"max-request-bytes", func(v *viper.Viper, cfg *Config) { cfg.MaxRequestBytes = v.GetInt64("max-request-bytes") }},
+	{"max-in-flight", func(v *viper.Viper, cfg *Config) { cfg.MaxInFlight = v.GetInt("max-in-flight") }},
+	{"max-queue", func(v *viper.Viper, cfg *Config) { cfg.MaxQueue = v.GetInt("max-queue") }},
+	{"max-queue-wait", func(v *viper.Viper, cfg *Config) { cfg.MaxQueueWait = v.GetDuration("max-queue-wait") }},
+	{"shed-policy", func(v *viper.Viper, cfg *Config) { cfg.ShedPolicy = v.GetString("shed-policy") }},
+	{"client-ca-file", func(v *viper.Viper, cfg *Config) { cfg.ClientCAFile = v.GetString("client-ca-file") }},
+	{"allowed-client-subjects", func(v *viper.Viper, cfg *Config) {
+		cfg.AllowedClientSubjects = splitList(v.GetStringSlice("allowed-client-subjects"))
+	}},
+	{"metrics-port", func(v *viper.Viper, cfg *Config) { cfg.MetricsPort = v.GetInt("metrics-port") }},
+	{"tracing-endpoint", func(v *viper.Viper, cfg *Config) { cfg.TracingEndpoint = v.GetString("tracing-endpoint") }},
+	{"tracing-sample-ratio", func(v *viper.Viper, cfg *Config) { cfg.TracingSampleRatio = v.GetFloat64("tracing-sample-ratio") }},
+	{"debug", func(v *viper.Viper, cfg *Config) { cfg.Debug = v.GetBool("debug") }},
+	{"on-error", func(v *viper.Viper, cfg *Config) { cfg.OnError = v.GetString("on-error") }},
+	{"mode", func(v *viper.Viper, cfg *Config) { cfg.Mode = v.GetString("mode") }},
+	{"label", func(v *viper.Viper, cfg *Config) { cfg.Label = v.GetString("label") }},
+}
+
+// splitList splits comma separated values, as given in an environment
+// variable, and drops empty ones
+func splitList(values []string) []string {
+	var list []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
 }
 
 // MergeWithOverrides applies environment and flag overrides onto a base config.
 // Precedence (lowest to highest): config file < environment < command line flags.
 // Only keys that are explicitly set in viper are overridden; unset keys are left intact.
 func MergeWithOverrides(v *viper.Viper, cfg *Config) *Config {
+	return MergeWithFlags(v, pflag.CommandLine, cfg)
+}
+
+// MergeWithFlags is MergeWithOverrides for a viper instance bound to flags
+// other than pflag.CommandLine. The flag set is only used to record whether
+// each override came from a flag or from the environment.
+func MergeWithFlags(v *viper.Viper, flags *pflag.FlagSet, cfg *Config) *Config {
 	if cfg == nil {
 		cfg = &Config{}
 	}
 	// environment and flags are both represented via Viper; use IsSet to guard
-	if v.IsSet("port") {
-		cfg.Port = v.GetInt("port")
+	for _, o := range overrides {
+		if v.IsSet(o.key) {
+			o.apply(v, cfg)
+			cfg.setSource(o.key, overrideSource(flags, o.key))
+		}
 	}
-	if v.IsSet("cert-dir") {
+	// Rules are only defined via config file currently; do not override here
+	return cfg
+}
 
-		cfg.CertDir = v.GetString("cert-dir")
+// ApplyDefaults fills in settings that were not set by the config file, the
+// environment or flags. Call Validate on the result, since overrides are not
+// checked when they are merged.
+func ApplyDefaults(cfg *Config) *Config {
+	if cfg == nil {
+		cfg = &Config{}
 	}
-	if v.IsSet("debug") {
-		cfg.Debug = v.GetBool("debug")
+	if cfg.Port == 0 {
+		cfg.Port = DefaultPort
+		cfg.setSource("port", Source{Kind: SourceDefault})
+	}
+	if cfg.CertDir == "" {
+		cfg.CertDir = DefaultCertDir
+		cfg.setSource("cert-dir", Source{Kind: SourceDefault})
+	}
+	if cfg.CertWaitTimeout == 0 {
+		cfg.CertWaitTimeout = DefaultCertWaitTimeout
+		cfg.setSource("cert-wait-timeout", Source{Kind: SourceDefault})
+	}
+	if cfg.CertExpiryThreshold == 0 {
+		cfg.CertExpiryThreshold = DefaultCertExpiryThreshold
+		cfg.setSource("cert-expiry-threshold", Source{Kind: SourceDefault})
+	}
+	if cfg.TLSMinVersion == "" {
+		cfg.TLSMinVersion = TLSVersion12
+		cfg.setSource("tls-min-version", Source{Kind: SourceDefault})
+	}
+	if cfg.ReadHeaderTimeout == 0 {
+		cfg.ReadHeaderTimeout = DefaultReadHeaderTimeout
+		cfg.setSource("read-header-timeout", Source{Kind: SourceDefault})
+	}
+	if cfg.ReadTimeout == 0 {
+		cfg.ReadTimeout = DefaultReadTimeout
+		cfg.setSource("read-timeout", Source{Kind: SourceDefault})
+	}
+	if cfg.WriteTimeout == 0 {
+		cfg.WriteTimeout = DefaultWriteTimeout
+		cfg.setSource("write-timeout", Source{Kind: SourceDefault})
+	}
+	if cfg.MaxRequestBytes == 0 {
+		cfg.MaxRequestBytes = DefaultMaxRequestBytes
+		cfg.setSource("max-request-bytes", Source{Kind: SourceDefault})
+	}
+	if cfg.MaxQueueWait == 0 && !cfg.isSet("max-queue-wait") {
+		cfg.MaxQueueWait = DefaultMaxQueueWait
+		cfg.setSource("max-queue-wait", Source{Kind: SourceDefault})
+	}
+	if cfg.ShedPolicy == "" {
+		cfg.ShedPolicy = OnErrorAllowWithWarning
+		cfg.setSource("shed-policy", Source{Kind: SourceDefault})
+	}
+	if cfg.DrainPeriod == 0 && !cfg.isSet("drain-period") {
+		cfg.DrainPeriod = DefaultDrainPeriod
+		cfg.setSource("drain-period", Source{Kind: SourceDefault})
+	}
+	if cfg.ShutdownTimeout == 0 {
+		cfg.ShutdownTimeout = DefaultShutdownTimeout
+		cfg.setSource("shutdown-timeout", Source{Kind: SourceDefault})
+	}
+	if cfg.TracingSampleRatio == 0 && !cfg.isSet("tracing-sample-ratio") {
+		cfg.TracingSampleRatio = DefaultTracingSampleRatio
+		cfg.setSource("tracing-sample-ratio", Source{Kind: SourceDefault})
+	}
+	if cfg.OnError == "" {
+		cfg.OnError = OnErrorAllow
+		cfg.setSource("on-error", Source{Kind: SourceDefault})
+	}
+	if cfg.Mode == "" {
+		cfg.Mode = ModeEnforce
+		cfg.setSource("mode", Source{Kind: SourceDefault})
 	}
-	// Rules are only defined via config file currently; do not override here
 	return cfg
 }
 
 // Matches checks if a VM in the given namespace with the given name matches any rule
 func (c *Config) Matches(namespace, vmName string) bool {
+	rule, _ := c.Match(namespace, vmName)
+	return rule != nil
+}
+
+// Match returns the first rule that selects the VM and the pattern that
+// matched, or nil if no rule does
+func (c *Config) Match(namespace, vmName string) (*NamespaceRuleConfig, string) {
+	i, pattern := c.match(namespace, vmName)
+	if i < 0 {
+		return nil, ""
+	}
+	return &c.Rules[i], pattern
+}
+
+// MatchVM is Match for callers that may match against slower sources than
+// the rules, such as namespace labels. It fails with ctx's error if ctx is
+// already done.
+func (c *Config) MatchVM(ctx context.Context, namespace, vmName string) (*NamespaceRuleConfig, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	rule, pattern := c.Match(namespace, vmName)
+	return rule, pattern, nil
+}
+
+// RuleName returns the name of rule, which must be one of c.Rules. Rules
+// without a name are called by their position, e.g. "rules[2]".
+func (c *Config) RuleName(rule *NamespaceRuleConfig) string {
+	if rule == nil {
+		return ""
+	}
+	if rule.Name != "" {
+		return rule.Name
+	}
+	for i := range c.Rules {
+		if &c.Rules[i] == rule {
+			return fmt.Sprintf("rules[%d]", i)
+		}
+	}
+	return rule.Namespace
+}
+
+// OnErrorPolicy returns the on-error policy for a VM selected by rule. rule
+// may be nil when the failure happened before any rule was matched.
+func (c *Config) OnErrorPolicy(rule *NamespaceRuleConfig) string {
+	if rule != nil && rule.OnError != "" {
+		return rule.OnError
+	}
+	if c != nil && c.OnError != "" {
+		return c.OnError
+	}
+	return OnErrorAllow
+}
+
+// ShedDecision returns the policy applied to VMs whose requests are shed
+func (c *Config) ShedDecision() string {
+	if c != nil && c.ShedPolicy != "" {
+		return c.ShedPolicy
+	}
+	return OnErrorAllowWithWarning
+}
+
+// RequestBytesLimit returns the largest request body to accept
+func (c *Config) RequestBytesLimit() int64 {
+	if c != nil && c.MaxRequestBytes > 0 {
+		return c.MaxRequestBytes
+	}
+	return DefaultMaxRequestBytes
+}
+
+// ModeFor returns the mode for a VM selected by rule, which may be nil
+func (c *Config) ModeFor(rule *NamespaceRuleConfig) string {
+	if rule != nil && rule.Mode != "" {
+		return rule.Mode
+	}
+	if c != nil && c.Mode != "" {
+		return c.Mode
+	}
+	return ModeEnforce
+}
+
+// MarkerLabel returns the label added to mutated VMs. ok is false if no
+// label is configured.
+func (c *Config) MarkerLabel() (key, value string, ok bool) {
+	if c == nil || c.Label == "" {
+		return "", "", false
+	}
+	key, value, _ = strings.Cut(c.Label, "=")
+	return key, value, true
+}
+
+// match returns the index of the first rule that selects the VM along with
+// the pattern that matched, or -1 if no rule does. The pattern is not enough
+// to tell: an empty pattern is valid and matches every name.
+func (c *Config) match(namespace, vmName string) (int, string) {
 	if c == nil {
-		return false
+		return -1, ""
 	}
 
 	rules := c.GetParsedRules()
-	for _, rule := range rules {
+	for i, rule := range rules {
 		if rule.Namespace == namespace {
 			for _, pattern := range rule.Patterns {
 				if pattern.MatchString(vmName) {
-					return true
+					return i, pattern.String()
 				}
 			}
 		}
 	}
 
-	return false
+	return -1, ""
 }
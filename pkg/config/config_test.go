@@ -1,14 +1,18 @@
 package config_test
 
 import (
+	"crypto/tls"
+	"errors"
 	"log/slog"
 	"os"
 	"strings"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
 	"github.com/jaevans/harvester-enable-nested-virt/pkg/config"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
@@ -51,6 +55,115 @@ port: not_a_number
 		})
 	})
 
+	Describe("ParseConfig", func() {
+		validationErrors := func(err error) config.ValidationErrors {
+			var verrs config.ValidationErrors
+			ExpectWithOffset(1, errors.As(err, &verrs)).To(BeTrue())
+			return verrs
+		}
+
+		It("should parse a valid configuration", func() {
+			cfg, err := config.ParseConfig([]byte(`
+debug: true
+rules:
+  - namespace: default
+    patterns:
+      - "^vm-.*"
+`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Debug).To(BeTrue())
+			Expect(cfg.Rules).To(HaveLen(1))
+			Expect(cfg.Matches("default", "vm-1")).To(BeTrue())
+		})
+
+		It("should accept an empty document", func() {
+			cfg, err := config.ParseConfig([]byte(""))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cfg.Rules).To(BeEmpty())
+		})
+
+		It("should reject unknown fields with their line and column", func() {
+			_, err := config.ParseConfig([]byte(`
+rules:
+  - namespace: default
+    pattern:
+      - "^vm-.*"
+`))
+			verrs := validationErrors(err)
+			Expect(verrs).To(HaveLen(1))
+			Expect(verrs[0].Line).To(Equal(4))
+			Expect(verrs[0].Column).To(Equal(5))
+			Expect(verrs[0].Field).To(Equal("rules[0].pattern"))
+			Expect(verrs[0].Error()).To(Equal(`line 4, column 5: rules[0].pattern: unknown field "pattern"`))
+		})
+
+		It("should report every invalid regex with its position", func() {
+			_, err := config.ParseConfig([]byte(`
+rules:
+  - namespace: default
+    patterns:
+      - "^vm-[.*"
+      - "^ok-.*"
+  - namespace: other
+    patterns: ["(unclosed"]
+`))
+			verrs := validationErrors(err)
+			Expect(verrs).To(HaveLen(2))
+			Expect(verrs[0].Field).To(Equal("rules[0].patterns[0]"))
+			Expect(verrs[0].Position).To(Equal(config.Position{Line: 5, Column: 9}))
+			Expect(verrs[0].Message).To(ContainSubstring("invalid pattern"))
+			Expect(verrs[1].Field).To(Equal("rules[1].patterns[0]"))
+			Expect(verrs[1].Position).To(Equal(config.Position{Line: 8, Column: 16}))
+		})
+
+		It("should require a namespace on every rule", func() {
+			_, err := config.ParseConfig([]byte(`
+rules:
+  - patterns: ["^vm-.*"]
+`))
+			verrs := validationErrors(err)
+			Expect(verrs).To(HaveLen(1))
+			Expect(verrs[0].Field).To(Equal("rules[0]"))
+			Expect(verrs[0].Message).To(Equal("namespace is required"))
+		})
+
+		It("should reject unknown on-error policies globally and per rule", func() {
+			_, err := config.ParseConfig([]byte(`
+on-error: ignore
+rules:
+  - namespace: default
+    patterns: ["^vm-.*"]
+    on-error: fail
+`))
+			verrs := validationErrors(err)
+			Expect(verrs).To(HaveLen(2))
+			Expect(verrs[0].Field).To(Equal("on-error"))
+			Expect(verrs[0].Position).To(Equal(config.Position{Line: 2, Column: 11}))
+			Expect(verrs[0].Message).To(Equal(`must be one of "allow", "allow-with-warning", "deny", got "ignore"`))
+			Expect(verrs[1].Field).To(Equal("rules[0].on-error"))
+			Expect(verrs[1].Position).To(Equal(config.Position{Line: 6, Column: 15}))
+		})
+
+		It("should report type errors and unknown fields together", func() {
+			_, err := config.ParseConfig([]byte(`
+port: not_a_number
+typo: true
+`))
+			verrs := validationErrors(err)
+			Expect(verrs).To(HaveLen(2))
+			Expect(verrs[0].Line).To(Equal(2))
+			Expect(verrs[0].Message).To(ContainSubstring("cannot unmarshal"))
+			Expect(verrs[1].Position).To(Equal(config.Position{Line: 3, Column: 1}))
+		})
+
+		It("should report syntax errors with their line", func() {
+			_, err := config.ParseConfig([]byte("rules:\n  - namespace: [\n"))
+			verrs := validationErrors(err)
+			Expect(verrs).To(HaveLen(1))
+			Expect(verrs[0].Line).To(BeNumerically(">", 0))
+		})
+	})
+
 	Describe("MergeWithOverrides", func() {
 
 		var (
@@ -230,6 +343,23 @@ port: not_a_number
 			Expect(cfg.Matches("any-namespace", "any-vm")).To(BeFalse())
 		})
 
+		It("should match every VM in the namespace with an empty pattern", func() {
+			cfg := &config.Config{
+				Rules: []config.NamespaceRuleConfig{
+					{
+						Namespace: "dev",
+						Patterns:  []string{""},
+					},
+				},
+			}
+
+			Expect(cfg.Matches("dev", "vm-1")).To(BeTrue())
+			rule, pattern := cfg.Match("dev", "vm-1")
+			Expect(rule).To(Equal(&cfg.Rules[0]))
+			Expect(pattern).To(BeEmpty())
+			Expect(cfg.Matches("prod", "vm-1")).To(BeFalse())
+		})
+
 		It("should handle multiple rules and patterns", func() {
 			cfg := &config.Config{
 				Rules: []config.NamespaceRuleConfig{
@@ -254,4 +384,231 @@ port: not_a_number
 			Expect(cfg.Matches("unknown-namespace", "vm-001")).To(BeFalse())
 		})
 	})
+
+	Describe("Match", func() {
+		It("should return the first rule that selects the VM and the pattern that matched", func() {
+			cfg := &config.Config{
+				Rules: []config.NamespaceRuleConfig{
+					{Namespace: "dev", Patterns: []string{"^vm-.*"}, OnError: config.OnErrorDeny},
+					{Namespace: "dev", Patterns: []string{".*"}},
+				},
+			}
+			rule, pattern := cfg.Match("dev", "vm-1")
+			Expect(rule).To(BeIdenticalTo(&cfg.Rules[0]))
+			Expect(pattern).To(Equal("^vm-.*"))
+
+			rule, pattern = cfg.Match("dev", "other")
+			Expect(rule).To(BeIdenticalTo(&cfg.Rules[1]))
+			Expect(pattern).To(Equal(".*"))
+
+			rule, pattern = cfg.Match("prod", "vm-1")
+			Expect(rule).To(BeNil())
+			Expect(pattern).To(BeEmpty())
+		})
+	})
+
+	Describe("OnErrorPolicy", func() {
+		It("should prefer the rule's policy, then the global one, then allow", func() {
+			rule := &config.NamespaceRuleConfig{Namespace: "dev"}
+			var cfg *config.Config
+			Expect(cfg.OnErrorPolicy(rule)).To(Equal(config.OnErrorAllow))
+
+			cfg = &config.Config{}
+			Expect(cfg.OnErrorPolicy(nil)).To(Equal(config.OnErrorAllow))
+
+			cfg.OnError = config.OnErrorAllowWithWarning
+			Expect(cfg.OnErrorPolicy(nil)).To(Equal(config.OnErrorAllowWithWarning))
+			Expect(cfg.OnErrorPolicy(rule)).To(Equal(config.OnErrorAllowWithWarning))
+
+			rule.OnError = config.OnErrorDeny
+			Expect(cfg.OnErrorPolicy(rule)).To(Equal(config.OnErrorDeny))
+		})
+	})
+
+	Describe("ModeFor", func() {
+		It("should let rules override the global mode", func() {
+			cfg := &config.Config{Rules: []config.NamespaceRuleConfig{{Namespace: "dev"}}}
+			rule := &cfg.Rules[0]
+			Expect(cfg.ModeFor(nil)).To(Equal(config.ModeEnforce))
+			Expect(cfg.ModeFor(rule)).To(Equal(config.ModeEnforce))
+
+			cfg.Mode = config.ModeShadow
+			Expect(cfg.ModeFor(rule)).To(Equal(config.ModeShadow))
+
+			rule.Mode = config.ModeEnforce
+			Expect(cfg.ModeFor(rule)).To(Equal(config.ModeEnforce))
+		})
+	})
+
+	Describe("Validate", func() {
+		It("should accept a config with defaults applied", func() {
+			Expect(config.ApplyDefaults(nil).Validate()).To(Succeed())
+		})
+
+		It("should name the environment variable an invalid value came from", func() {
+			GinkgoT().Setenv("NESTED_VIRT_ON_ERROR", "ignore")
+			v := viper.New()
+			v.SetEnvPrefix(config.EnvPrefix)
+			v.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+			v.AutomaticEnv()
+
+			cfg := config.MergeWithFlags(v, pflag.NewFlagSet("test", pflag.ContinueOnError), nil)
+			Expect(cfg.Validate()).To(MatchError(
+				`on-error: must be one of "allow", "allow-with-warning", "deny", got "ignore" (set by NESTED_VIRT_ON_ERROR)`))
+		})
+
+		It("should keep a drain period explicitly set to zero", func() {
+			Expect(config.ApplyDefaults(&config.Config{}).DrainPeriod).To(Equal(config.DefaultDrainPeriod))
+
+			cfg, err := config.ParseConfig([]byte("drain-period: 0s\n"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.ApplyDefaults(cfg).DrainPeriod).To(BeZero())
+
+			GinkgoT().Setenv("NESTED_VIRT_DRAIN_PERIOD", "0s")
+			v := viper.New()
+			v.SetEnvPrefix(config.EnvPrefix)
+			v.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+			v.AutomaticEnv()
+			cfg = config.ApplyDefaults(config.MergeWithFlags(v, pflag.NewFlagSet("test", pflag.ContinueOnError), nil))
+			Expect(cfg.DrainPeriod).To(BeZero())
+			Expect(cfg.Source("drain-period").Kind).To(Equal(config.SourceEnv))
+		})
+
+		It("should reject negative durations", func() {
+			cfg := config.ApplyDefaults(&config.Config{CertWaitTimeout: -time.Second})
+			Expect(cfg.Validate()).To(MatchError("cert-wait-timeout: must not be negative, got -1s"))
+		})
+
+		It("should reject a metrics port that is the webhook port", func() {
+			cfg := config.ApplyDefaults(&config.Config{MetricsPort: config.DefaultPort})
+			Expect(cfg.Validate()).To(MatchError(ContainSubstring("metrics-port: must differ from port 8443")))
+
+			cfg.MetricsPort = 8080
+			Expect(cfg.Validate()).To(Succeed())
+		})
+
+		It("should check the load shedding limits", func() {
+			cfg := config.ApplyDefaults(&config.Config{MaxQueue: 10})
+			Expect(cfg.Validate()).To(MatchError("max-queue: requires max-in-flight"))
+
+			cfg.MaxInFlight = -1
+			Expect(cfg.Validate()).To(MatchError(ContainSubstring("max-in-flight: must not be negative, got -1")))
+
+			cfg.MaxInFlight = 20
+			Expect(cfg.Validate()).To(Succeed())
+			Expect(cfg.ShedDecision()).To(Equal(config.OnErrorAllowWithWarning))
+			Expect(cfg.MaxQueueWait).To(Equal(config.DefaultMaxQueueWait))
+
+			cfg, err := config.ParseConfig([]byte("max-queue-wait: 0s\n"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.ApplyDefaults(cfg).MaxQueueWait).To(BeZero())
+		})
+
+		It("should require a client CA bundle for allowed client subjects", func() {
+			cfg := config.ApplyDefaults(&config.Config{AllowedClientSubjects: []string{"kube-apiserver"}})
+			Expect(cfg.Validate()).To(MatchError("allowed-client-subjects: requires client-ca-file"))
+
+			cfg.ClientCAFile = "/etc/webhook/client-ca/ca.crt"
+			Expect(cfg.Validate()).To(Succeed())
+		})
+
+		It("should check the tracing endpoint and sample ratio", func() {
+			cfg := config.ApplyDefaults(&config.Config{TracingEndpoint: "otel-collector:4318"})
+			Expect(cfg.TracingSampleRatio).To(Equal(config.DefaultTracingSampleRatio))
+			Expect(cfg.Validate()).To(MatchError(`tracing-endpoint: must be an http or https URL, got "otel-collector:4318"`))
+
+			cfg.TracingEndpoint = "http://otel-collector:4318"
+			cfg.TracingSampleRatio = 1.5
+			Expect(cfg.Validate()).To(MatchError("tracing-sample-ratio: must be between 0 and 1, got 1.5"))
+
+			cfg.TracingSampleRatio = 0.1
+			Expect(cfg.Validate()).To(Succeed())
+
+			cfg, err := config.ParseConfig([]byte("tracing-sample-ratio: 0\n"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.ApplyDefaults(cfg).TracingSampleRatio).To(BeZero())
+		})
+
+		It("should split allowed client subjects set in the environment", func() {
+			GinkgoT().Setenv("NESTED_VIRT_ALLOWED_CLIENT_SUBJECTS", "kube-apiserver, front-proxy-client")
+			v := viper.New()
+			v.SetEnvPrefix(config.EnvPrefix)
+			v.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+			v.AutomaticEnv()
+
+			cfg := config.MergeWithFlags(v, pflag.NewFlagSet("test", pflag.ContinueOnError), nil)
+			Expect(cfg.AllowedClientSubjects).To(Equal([]string{"kube-apiserver", "front-proxy-client"}))
+		})
+
+		DescribeTable("should check the TLS policy and bind address",
+			func(cfg *config.Config, expected string) {
+				err := config.ApplyDefaults(cfg).Validate()
+				if expected == "" {
+					Expect(err).NotTo(HaveOccurred())
+				} else {
+					Expect(err).To(MatchError(expected))
+				}
+			},
+			Entry("IPv6 address", &config.Config{BindAddress: "::1"}, ""),
+			Entry("host name", &config.Config{BindAddress: "localhost"},
+				`bind-address: must be an IPv4 or IPv6 address, got "localhost"`),
+			Entry("unknown TLS version", &config.Config{TLSMinVersion: "1.1"},
+				`tls-min-version: must be one of "1.2", "1.3", got "1.1"`),
+			Entry("TLS 1.2 cipher suite", &config.Config{TLSCipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}}, ""),
+			Entry("insecure cipher suite", &config.Config{TLSCipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_RSA_WITH_RC4_128_SHA"}},
+				`tls-cipher-suites[1]: unknown or insecure TLS 1.2 cipher suite "TLS_RSA_WITH_RC4_128_SHA"`),
+			Entry("TLS 1.3 cipher suite", &config.Config{TLSCipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_AES_128_GCM_SHA256"}},
+				`tls-cipher-suites[1]: "TLS_AES_128_GCM_SHA256" is a TLS 1.3 cipher suite, which cannot be configured`),
+			Entry("cipher suites with TLS 1.3 only", &config.Config{
+				TLSMinVersion:   config.TLSVersion13,
+				TLSCipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+			}, "tls-cipher-suites: only apply to TLS 1.2, which tls-min-version 1.3 does not accept"),
+			Entry("cipher suites without one HTTP/2 requires", &config.Config{TLSCipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}},
+				"tls-cipher-suites: must include TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, which HTTP/2 requires"),
+			Entry("unknown curve", &config.Config{TLSCurvePreferences: []string{"X25519", "P-192"}},
+				`tls-curve-preferences[1]: unknown curve "P-192"`),
+		)
+
+		It("should convert the TLS policy for crypto/tls", func() {
+			cfg := config.ApplyDefaults(&config.Config{
+				TLSCipherSuites:     []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"},
+				TLSCurvePreferences: []string{"P-384", "X25519"},
+			})
+			Expect(cfg.MinTLSVersion()).To(Equal(uint16(tls.VersionTLS12)))
+			Expect(cfg.CipherSuiteIDs()).To(Equal([]uint16{
+				tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+				tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			}))
+			Expect(cfg.CurveIDs()).To(Equal([]tls.CurveID{tls.CurveP384, tls.X25519}))
+
+			cfg.TLSMinVersion = config.TLSVersion13
+			Expect(cfg.MinTLSVersion()).To(Equal(uint16(tls.VersionTLS13)))
+		})
+
+		DescribeTable("should check the label",
+			func(label, expected string) {
+				err := (&config.Config{Label: label}).Validate()
+				if expected == "" {
+					Expect(err).NotTo(HaveOccurred())
+				} else {
+					Expect(err).To(MatchError(ContainSubstring(expected)))
+				}
+			},
+			Entry("prefixed key", "nested-virt.jaevans.io/enabled=true", ""),
+			Entry("empty value", "nested=", ""),
+			Entry("missing value", "nested", "label: must be key=value"),
+			Entry("invalid key", "bad key=true", "label: invalid key"),
+			Entry("invalid value", "nested=not ok", "label: invalid value"),
+		)
+
+		It("should split the label into key and value", func() {
+			key, value, ok := (&config.Config{Label: "nested-virt.jaevans.io/enabled=true"}).MarkerLabel()
+			Expect(ok).To(BeTrue())
+			Expect(key).To(Equal("nested-virt.jaevans.io/enabled"))
+			Expect(value).To(Equal("true"))
+
+			_, _, ok = (&config.Config{}).MarkerLabel()
+			Expect(ok).To(BeFalse())
+		})
+	})
 })
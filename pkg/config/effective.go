@@ -0,0 +1,155 @@
+package config
+
+import (
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// Kinds of Source
+const (
+	SourceDefault  = "default"
+	SourceFile     = "file"
+	SourceEnv      = "env"
+	SourceFlag     = "flag"
+	SourceOverride = "override"
+)
+
+// Source describes where the effective value of a setting came from
+type Source struct {
+	// Kind is one of SourceDefault, SourceFile, SourceEnv, SourceFlag, or
+	// SourceOverride for values set directly on the viper instance.
+	Kind string `json:"kind" yaml:"kind"`
+	// Name is the file path, environment variable or flag, if any
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+}
+
+func (s Source) String() string {
+	if s.Name == "" {
+		return s.Kind
+	}
+	return s.Kind + ":" + s.Name
+}
+
+// EnvVar returns the environment variable that overrides the setting key
+func EnvVar(key string) string {
+	return EnvPrefix + "_" + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+}
+
+// Source returns where the setting with the given YAML key was set from.
+// Settings that were never set report SourceDefault.
+func (c *Config) Source(key string) Source {
+	if src, ok := c.sources[key]; ok {
+		return src
+	}
+	return Source{Kind: SourceDefault}
+}
+
+// isSet reports whether the setting with the given YAML key was set in the
+// configuration document, the environment or a flag, which tells a setting
+// explicitly set to its zero value apart from one left unset
+func (c *Config) isSet(key string) bool {
+	if src, ok := c.sources[key]; ok && src.Kind != SourceDefault {
+		return true
+	}
+	_, ok := c.positions[key]
+	return ok
+}
+
+func (c *Config) setSource(key string, src Source) {
+	if c.sources == nil {
+		c.sources = map[string]Source{}
+	}
+	c.sources[key] = src
+}
+
+// overrideSource works out whether viper took key from a flag or from the
+// environment, following viper's own precedence.
+func overrideSource(flags *pflag.FlagSet, key string) Source {
+	if flags != nil {
+		if f := flags.Lookup(key); f != nil && f.Changed {
+			return Source{Kind: SourceFlag, Name: "--" + key}
+		}
+	}
+	if _, ok := os.LookupEnv(EnvVar(key)); ok {
+		return Source{Kind: SourceEnv, Name: EnvVar(key)}
+	}
+	return Source{Kind: SourceOverride}
+}
+
+// EffectiveConfig is the configuration in use once defaults, the config file,
+// the environment and flags have been layered, with the source of each value
+type EffectiveConfig struct {
+	Values map[string]EffectiveValue `json:"values" yaml:"values"`
+	Rules  []CompiledRule            `json:"rules" yaml:"rules"`
+	Tests  int                       `json:"tests" yaml:"tests"`
+}
+
+// EffectiveValue is a setting's value and where it came from. Durations
+// are given as strings such as "24h0m0s".
+type EffectiveValue struct {
+	Value  any    `json:"value" yaml:"value"`
+	Source Source `json:"source" yaml:"source"`
+}
+
+// CompiledRule is a rule as it is used for matching. Patterns holds the
+// compiled regular expressions; Dropped holds any that failed to compile and
+// are ignored.
+type CompiledRule struct {
+	Name      string   `json:"name" yaml:"name"`
+	Namespace string   `json:"namespace" yaml:"namespace"`
+	Patterns  []string `json:"patterns" yaml:"patterns"`
+	Dropped   []string `json:"dropped,omitempty" yaml:"dropped,omitempty"`
+	// OnError is the policy in effect for the rule, its own or the global one
+	OnError string `json:"on-error" yaml:"on-error"`
+	// Mode is the mode in effect for the rule, its own or the global one
+	Mode string `json:"mode" yaml:"mode"`
+}
+
+// Effective returns the effective configuration. Every setting is listed
+// under its YAML key; rules are listed as compiled and tests are counted.
+func (c *Config) Effective() EffectiveConfig {
+	eff := EffectiveConfig{
+		Values: map[string]EffectiveValue{},
+		Rules:  []CompiledRule{},
+		Tests:  len(c.Tests),
+	}
+
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		key, _, ok := yamlName(v.Type().Field(i))
+		if !ok || key == "rules" || key == "tests" {
+			continue
+		}
+		value := v.Field(i).Interface()
+		if d, ok := value.(time.Duration); ok {
+			// Written the way ParseConfig reads it, rather than as nanoseconds
+			value = d.String()
+		}
+		eff.Values[key] = EffectiveValue{Value: value, Source: c.Source(key)}
+	}
+
+	for i, rule := range c.GetParsedRules() {
+		compiled := CompiledRule{
+			Name:      c.RuleName(&c.Rules[i]),
+			Namespace: rule.Namespace,
+			Patterns:  make([]string, 0, len(rule.Patterns)),
+			OnError:   c.OnErrorPolicy(&c.Rules[i]),
+			Mode:      c.ModeFor(&c.Rules[i]),
+		}
+		for _, pattern := range rule.Patterns {
+			compiled.Patterns = append(compiled.Patterns, pattern.String())
+		}
+		for _, pattern := range c.Rules[i].Patterns {
+			if !slices.Contains(compiled.Patterns, pattern) {
+				compiled.Dropped = append(compiled.Dropped, pattern)
+			}
+		}
+		eff.Rules = append(eff.Rules, compiled)
+	}
+	return eff
+}
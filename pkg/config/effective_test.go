@@ -0,0 +1,136 @@
+package config_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/config"
+)
+
+var _ = Describe("Effective configuration", func() {
+	var (
+		configFile string
+		flags      *pflag.FlagSet
+		v          *viper.Viper
+	)
+
+	BeforeEach(func() {
+		configFile = GinkgoT().TempDir() + "/config.yaml"
+		Expect(os.WriteFile(configFile, []byte(`
+port: 9000
+rules:
+  - namespace: dev
+    patterns:
+      - "^vm-.*"
+`), 0644)).To(Succeed())
+
+		flags = pflag.NewFlagSet("test", pflag.ContinueOnError)
+		flags.Int("port", config.DefaultPort, "")
+		flags.String("cert-dir", config.DefaultCertDir, "")
+		flags.Bool("debug", false, "")
+
+		v = viper.New()
+		Expect(v.BindPFlags(flags)).To(Succeed())
+		v.SetEnvPrefix(config.EnvPrefix)
+		v.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+		v.AutomaticEnv()
+	})
+
+	load := func() *config.Config {
+		cfg, err := config.LoadConfig(configFile)
+		ExpectWithOffset(1, err).NotTo(HaveOccurred())
+		return config.ApplyDefaults(config.MergeWithFlags(v, flags, cfg))
+	}
+
+	It("should record the source of every setting", func() {
+		GinkgoT().Setenv("NESTED_VIRT_DEBUG", "true")
+		Expect(flags.Parse([]string{"--cert-dir=/flag/certs"})).To(Succeed())
+
+		cfg := load()
+		Expect(cfg.Source("port")).To(Equal(config.Source{Kind: config.SourceFile, Name: configFile}))
+		Expect(cfg.Source("debug")).To(Equal(config.Source{Kind: config.SourceEnv, Name: "NESTED_VIRT_DEBUG"}))
+		Expect(cfg.Source("cert-dir")).To(Equal(config.Source{Kind: config.SourceFlag, Name: "--cert-dir"}))
+		Expect(cfg.Source("rules").Kind).To(Equal(config.SourceFile))
+	})
+
+	It("should prefer flags over the environment", func() {
+		GinkgoT().Setenv("NESTED_VIRT_PORT", "9100")
+		Expect(flags.Parse([]string{"--port=9200"})).To(Succeed())
+
+		cfg := load()
+		Expect(cfg.Port).To(Equal(9200))
+		Expect(cfg.Source("port").String()).To(Equal("flag:--port"))
+	})
+
+	It("should report defaults for settings that are not set anywhere", func() {
+		cfg := load()
+		Expect(cfg.CertDir).To(Equal(config.DefaultCertDir))
+		Expect(cfg.Source("cert-dir")).To(Equal(config.Source{Kind: config.SourceDefault}))
+		Expect(cfg.Source("debug").String()).To(Equal("default"))
+	})
+
+	It("should report values set directly on viper as overrides", func() {
+		v.Set("debug", true)
+		cfg := load()
+		Expect(cfg.Source("debug")).To(Equal(config.Source{Kind: config.SourceOverride}))
+	})
+
+	It("should apply defaults to an empty config", func() {
+		cfg := config.ApplyDefaults(nil)
+		Expect(cfg.Port).To(Equal(config.DefaultPort))
+		Expect(cfg.CertDir).To(Equal(config.DefaultCertDir))
+	})
+
+	Describe("Effective", func() {
+		It("should list every setting with its value and source", func() {
+			GinkgoT().Setenv("NESTED_VIRT_DEBUG", "true")
+			eff := load().Effective()
+
+			Expect(eff.Values).To(HaveKeyWithValue("port", config.EffectiveValue{
+				Value: 9000, Source: config.Source{Kind: config.SourceFile, Name: configFile},
+			}))
+			Expect(eff.Values).To(HaveKeyWithValue("debug", config.EffectiveValue{
+				Value: true, Source: config.Source{Kind: config.SourceEnv, Name: "NESTED_VIRT_DEBUG"},
+			}))
+			Expect(eff.Values).To(HaveKey("cert-dir"))
+			Expect(eff.Values).To(HaveKeyWithValue("cert-expiry-threshold", config.EffectiveValue{
+				Value: "24h0m0s", Source: config.Source{Kind: config.SourceDefault},
+			}))
+			Expect(eff.Values).NotTo(HaveKey("rules"))
+			Expect(eff.Rules).To(Equal([]config.CompiledRule{{Name: "rules[0]", Namespace: "dev", Patterns: []string{"^vm-.*"}, OnError: config.OnErrorAllow, Mode: config.ModeEnforce}}))
+		})
+
+		It("should write durations in JSON the way ParseConfig reads them", func() {
+			data, err := json.Marshal(load().Effective())
+			Expect(err).NotTo(HaveOccurred())
+			var eff struct {
+				Values map[string]struct{ Value any } `json:"values"`
+			}
+			Expect(json.Unmarshal(data, &eff)).To(Succeed())
+			threshold := eff.Values["cert-expiry-threshold"].Value
+			Expect(threshold).To(Equal("24h0m0s"))
+
+			_, err = config.ParseConfig([]byte(fmt.Sprintf("cert-expiry-threshold: %s\n", threshold)))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should list patterns dropped from the compiled rules", func() {
+			cfg := &config.Config{
+				Rules: []config.NamespaceRuleConfig{
+					{Namespace: "dev", Patterns: []string{"^vm-.*", "^vm-[.*"}},
+				},
+			}
+			eff := cfg.Effective()
+			Expect(eff.Rules).To(HaveLen(1))
+			Expect(eff.Rules[0].Patterns).To(Equal([]string{"^vm-.*"}))
+			Expect(eff.Rules[0].Dropped).To(Equal([]string{"^vm-[.*"}))
+		})
+	})
+})
@@ -0,0 +1,209 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+)
+
+// Severity indicates how serious a lint finding is
+type Severity string
+
+const (
+	// SeverityError marks a finding that makes a rule ineffective
+	SeverityError Severity = "error"
+	// SeverityWarning marks a finding that is probably, but not certainly, a mistake
+	SeverityWarning Severity = "warning"
+)
+
+// Lint finding codes
+const (
+	LintDuplicateNamespace = "duplicate-namespace"
+	LintDuplicatePattern   = "duplicate-pattern"
+	LintShadowedPattern    = "shadowed-pattern"
+	LintUnanchoredPattern  = "unanchored-pattern"
+	LintEmptyRule          = "empty-rule"
+)
+
+// Finding is a single problem reported by Lint
+type Finding struct {
+	Severity Severity `json:"severity"`
+	Code     string   `json:"code"`
+	// Field is the path of the offending value, e.g. "rules[0].patterns[1]"
+	Field string `json:"field"`
+	Position
+	Message string `json:"message"`
+}
+
+// Lint looks for rules that are valid but probably not what was intended:
+// namespaces configured by more than one rule, patterns repeated or made
+// redundant by a match-all pattern in the same namespace, patterns that are
+// not anchored at either end, and rules left with no usable patterns once
+// invalid ones are dropped. Findings are returned in rule order.
+func Lint(c *Config) []Finding {
+	if c == nil {
+		return nil
+	}
+
+	type seenPattern struct {
+		field   string
+		pattern string
+	}
+	var (
+		findings     []Finding
+		firstRule    = map[string]int{}
+		seen         = map[string][]seenPattern{}
+		matchAllSeen = map[string]seenPattern{}
+	)
+
+	// Match-all patterns shadow everything else in their namespace, including
+	// patterns in earlier rules, so find them before looking at the rest.
+	for i, rule := range c.Rules {
+		for j, pattern := range rule.Patterns {
+			if _, ok := matchAllSeen[rule.Namespace]; !ok && matchesAll(pattern) {
+				matchAllSeen[rule.Namespace] = seenPattern{fmt.Sprintf("rules[%d].patterns[%d]", i, j), pattern}
+			}
+		}
+	}
+
+	for i, rule := range c.Rules {
+		ruleField := fmt.Sprintf("rules[%d]", i)
+		if first, ok := firstRule[rule.Namespace]; ok {
+			findings = append(findings, c.finding(SeverityWarning, LintDuplicateNamespace, ruleField,
+				"namespace %q is already configured by rules[%d]; merge the patterns into one rule", rule.Namespace, first))
+		} else {
+			firstRule[rule.Namespace] = i
+		}
+
+		valid := 0
+		for j, pattern := range rule.Patterns {
+			field := fmt.Sprintf("%s.patterns[%d]", ruleField, j)
+			if _, err := regexp.Compile(pattern); err != nil {
+				continue
+			}
+			valid++
+
+			if matchAll, ok := matchAllSeen[rule.Namespace]; ok && matchAll.field != field {
+				findings = append(findings, c.finding(SeverityWarning, LintShadowedPattern, field,
+					"pattern %q is redundant: %q at %s already matches every VM in namespace %q",
+					pattern, matchAll.pattern, matchAll.field, rule.Namespace))
+			} else if !ok {
+				if reason := unanchored(pattern); reason != "" {
+					findings = append(findings, c.finding(SeverityWarning, LintUnanchoredPattern, field,
+						"pattern %q %s; add ^ or $ (or an explicit .*) to make the intent clear", pattern, reason))
+				}
+			}
+
+			for _, prev := range seen[rule.Namespace] {
+				if prev.pattern == pattern {
+					findings = append(findings, c.finding(SeverityWarning, LintDuplicatePattern, field,
+						"pattern %q duplicates %s", pattern, prev.field))
+					break
+				}
+			}
+			seen[rule.Namespace] = append(seen[rule.Namespace], seenPattern{field, pattern})
+		}
+
+		if valid == 0 {
+			findings = append(findings, c.finding(SeverityError, LintEmptyRule, ruleField,
+				"rule for namespace %q has no valid patterns and never matches", rule.Namespace))
+		}
+	}
+	return findings
+}
+
+func (c *Config) finding(severity Severity, code, field, format string, args ...any) Finding {
+	return Finding{
+		Severity: severity,
+		Code:     code,
+		Field:    field,
+		Position: c.position(field),
+		Message:  fmt.Sprintf(format, args...),
+	}
+}
+
+// matchesAll reports whether pattern matches every VM name, i.e. it is some
+// spelling of .* optionally anchored at either end, or an empty pattern
+// anchored at no more than one end, such as "" or "^".
+func matchesAll(pattern string) bool {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return false
+	}
+	var (
+		rest       []*syntax.Regexp
+		begin, end bool
+	)
+	for _, sub := range concatenation(re.Simplify()) {
+		switch sub.Op {
+		case syntax.OpBeginText, syntax.OpBeginLine:
+			begin = true
+		case syntax.OpEndText, syntax.OpEndLine:
+			end = true
+		case syntax.OpEmptyMatch:
+		default:
+			rest = append(rest, sub)
+		}
+	}
+	if len(rest) == 0 {
+		// Anchored at both ends, it only matches an empty name
+		return !begin || !end
+	}
+	return len(rest) == 1 && isAnyStar(rest[0])
+}
+
+// unanchored explains why pattern can match anywhere inside a VM name, or
+// returns "" if it is anchored at the start or the end. A leading or trailing
+// .* counts as an explicit anchor. Every alternative of a top-level
+// alternation must be anchored, which catches the common mistake "^a|b".
+func unanchored(pattern string) string {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	re = stripCapture(re.Simplify())
+	alternatives := []*syntax.Regexp{re}
+	if re.Op == syntax.OpAlternate {
+		alternatives = re.Sub
+	}
+	for _, alt := range alternatives {
+		parts := concatenation(alt)
+		if len(parts) == 0 {
+			continue
+		}
+		first, last := parts[0], parts[len(parts)-1]
+		anchored := first.Op == syntax.OpBeginText || first.Op == syntax.OpBeginLine || isAnyStar(first) ||
+			last.Op == syntax.OpEndText || last.Op == syntax.OpEndLine || isAnyStar(last)
+		if !anchored {
+			if len(alternatives) > 1 {
+				return fmt.Sprintf("has an alternative (%s) that is not anchored", alt)
+			}
+			return "is not anchored and matches anywhere in the name"
+		}
+	}
+	return ""
+}
+
+// concatenation returns the top-level sequence of re with capture groups removed
+func concatenation(re *syntax.Regexp) []*syntax.Regexp {
+	re = stripCapture(re)
+	if re.Op != syntax.OpConcat {
+		return []*syntax.Regexp{re}
+	}
+	parts := make([]*syntax.Regexp, len(re.Sub))
+	for i, sub := range re.Sub {
+		parts[i] = stripCapture(sub)
+	}
+	return parts
+}
+
+func stripCapture(re *syntax.Regexp) *syntax.Regexp {
+	for re.Op == syntax.OpCapture {
+		re = re.Sub[0]
+	}
+	return re
+}
+
+func isAnyStar(re *syntax.Regexp) bool {
+	return re.Op == syntax.OpStar && (re.Sub[0].Op == syntax.OpAnyCharNotNL || re.Sub[0].Op == syntax.OpAnyChar)
+}
@@ -0,0 +1,144 @@
+package config_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/onsi/gomega/gstruct"
+
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/config"
+)
+
+var _ = Describe("Lint", func() {
+	finding := func(code, field string) OmegaMatcher {
+		return MatchFields(IgnoreExtras, Fields{
+			"Code":  Equal(code),
+			"Field": Equal(field),
+		})
+	}
+
+	It("should return nothing for a nil config", func() {
+		Expect(config.Lint(nil)).To(BeEmpty())
+	})
+
+	It("should return nothing for well-formed rules", func() {
+		cfg := &config.Config{
+			Rules: []config.NamespaceRuleConfig{
+				{Namespace: "default", Patterns: []string{"^vm-.*", ".*-prod$", "^(a|b)-"}},
+				{Namespace: "dev", Patterns: []string{".*"}},
+			},
+		}
+		Expect(config.Lint(cfg)).To(BeEmpty())
+	})
+
+	It("should flag namespaces configured by more than one rule", func() {
+		cfg := &config.Config{
+			Rules: []config.NamespaceRuleConfig{
+				{Namespace: "default", Patterns: []string{"^vm-.*"}},
+				{Namespace: "default", Patterns: []string{"^test-.*"}},
+			},
+		}
+		findings := config.Lint(cfg)
+		Expect(findings).To(ConsistOf(finding(config.LintDuplicateNamespace, "rules[1]")))
+		Expect(findings[0].Severity).To(Equal(config.SeverityWarning))
+	})
+
+	It("should flag patterns shadowed by a match-all pattern in the same namespace", func() {
+		cfg := &config.Config{
+			Rules: []config.NamespaceRuleConfig{
+				{Namespace: "dev", Patterns: []string{"^vm-.*", "^.*$"}},
+				{Namespace: "other", Patterns: []string{"^vm-.*"}},
+			},
+		}
+		findings := config.Lint(cfg)
+		Expect(findings).To(ConsistOf(finding(config.LintShadowedPattern, "rules[0].patterns[0]")))
+		Expect(findings[0].Message).To(ContainSubstring("rules[0].patterns[1]"))
+	})
+
+	It("should flag shadowed patterns across rules for the same namespace", func() {
+		cfg := &config.Config{
+			Rules: []config.NamespaceRuleConfig{
+				{Namespace: "dev", Patterns: []string{"^vm-.*"}},
+				{Namespace: "dev", Patterns: []string{"(.*)"}},
+			},
+		}
+		Expect(config.Lint(cfg)).To(ConsistOf(
+			finding(config.LintShadowedPattern, "rules[0].patterns[0]"),
+			finding(config.LintDuplicateNamespace, "rules[1]"),
+		))
+	})
+
+	DescribeTable("should treat empty patterns as matching every VM",
+		func(pattern string, matchAll bool) {
+			cfg := &config.Config{
+				Rules: []config.NamespaceRuleConfig{{Namespace: "dev", Patterns: []string{"^vm-.*", pattern}}},
+			}
+			if matchAll {
+				Expect(config.Lint(cfg)).To(ConsistOf(finding(config.LintShadowedPattern, "rules[0].patterns[0]")))
+			} else {
+				Expect(config.Lint(cfg)).To(BeEmpty())
+			}
+		},
+		Entry("empty pattern", "", true),
+		Entry("start anchor", "^", true),
+		Entry("end anchor", `\z`, true),
+		Entry("empty group", "()", true),
+		Entry("anchored at both ends", "^$", false),
+	)
+
+	DescribeTable("should flag unanchored patterns",
+		func(pattern string, flagged bool) {
+			cfg := &config.Config{
+				Rules: []config.NamespaceRuleConfig{{Namespace: "default", Patterns: []string{pattern}}},
+			}
+			if flagged {
+				Expect(config.Lint(cfg)).To(ConsistOf(finding(config.LintUnanchoredPattern, "rules[0].patterns[0]")))
+			} else {
+				Expect(config.Lint(cfg)).To(BeEmpty())
+			}
+		},
+		Entry("bare literal", "vm", true),
+		Entry("unanchored alternative", "^a|b", true),
+		Entry("start anchor", "^vm-", false),
+		Entry("end anchor", "-prod$", false),
+		Entry("explicit leading wildcard", ".*-prod", false),
+		Entry("explicit trailing wildcard", "vm-.*", false),
+		Entry("anchored alternation", "^(vm|test)-", false),
+	)
+
+	It("should flag repeated patterns in a namespace", func() {
+		cfg := &config.Config{
+			Rules: []config.NamespaceRuleConfig{
+				{Namespace: "default", Patterns: []string{"^vm-.*", "^vm-.*"}},
+			},
+		}
+		Expect(config.Lint(cfg)).To(ConsistOf(finding(config.LintDuplicatePattern, "rules[0].patterns[1]")))
+	})
+
+	It("should flag rules with no patterns left after invalid ones are dropped", func() {
+		cfg := &config.Config{
+			Rules: []config.NamespaceRuleConfig{
+				{Namespace: "default", Patterns: []string{"^vm-[.*"}},
+				{Namespace: "empty"},
+			},
+		}
+		findings := config.Lint(cfg)
+		Expect(findings).To(ConsistOf(
+			finding(config.LintEmptyRule, "rules[0]"),
+			finding(config.LintEmptyRule, "rules[1]"),
+		))
+		Expect(findings[0].Severity).To(Equal(config.SeverityError))
+	})
+
+	It("should report positions for configs parsed from YAML", func() {
+		cfg, err := config.ParseConfig([]byte(`
+rules:
+  - namespace: default
+    patterns:
+      - "vm"
+`))
+		Expect(err).NotTo(HaveOccurred())
+		findings := config.Lint(cfg)
+		Expect(findings).To(HaveLen(1))
+		Expect(findings[0].Position).To(Equal(config.Position{Line: 5, Column: 9}))
+	})
+})
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Expected outcomes for a RuleTest
+const (
+	ExpectMatch   = "match"
+	ExpectNoMatch = "no-match"
+)
+
+// RuleTest is an expectation about whether the rules select a VM. Tests are
+// embedded in the configuration file and run every time it is parsed, so a
+// rule change that breaks one is rejected before it reaches the cluster.
+type RuleTest struct {
+	Description string `yaml:"description,omitempty" description:"Shown alongside the failure when the test does not pass"`
+	Namespace   string `yaml:"namespace" description:"Namespace of the VM"`
+	VMName      string `yaml:"vm-name" description:"Name of the VM"`
+	// Labels are the VM's labels. Rules currently select on namespace and
+	// name only, so labels do not affect the outcome yet.
+	Labels map[string]string `yaml:"labels,omitempty" description:"Labels of the VM"`
+	// Expect is either ExpectMatch or ExpectNoMatch
+	Expect string `yaml:"expect" description:"Whether the rules should select the VM" enum:"match,no-match"`
+}
+
+// checkTests reports tests that are malformed. Well-formed tests are run by
+// runTests once the rules themselves are known to be valid.
+func (c *Config) checkTests() ValidationErrors {
+	var errs ValidationErrors
+	for i, test := range c.Tests {
+		field := fmt.Sprintf("tests[%d]", i)
+		var missing []string
+		if test.Namespace == "" {
+			missing = append(missing, "namespace")
+		}
+		if test.VMName == "" {
+			missing = append(missing, "vm-name")
+		}
+		if len(missing) > 0 {
+			errs = append(errs, ValidationError{
+				Position: c.position(field),
+				Field:    field,
+				Message:  strings.Join(missing, " and ") + " required",
+			})
+		}
+		if test.Expect != ExpectMatch && test.Expect != ExpectNoMatch {
+			expectField := field + ".expect"
+			pos := c.position(expectField)
+			if pos.Line == 0 {
+				expectField, pos = field, c.position(field)
+			}
+			errs = append(errs, ValidationError{
+				Position: pos,
+				Field:    expectField,
+				Message:  fmt.Sprintf("expect must be %q or %q, got %q", ExpectMatch, ExpectNoMatch, test.Expect),
+			})
+		}
+	}
+	return errs
+}
+
+// runTests evaluates each test against the compiled rules and reports every
+// test whose outcome differs from its expectation.
+func (c *Config) runTests() ValidationErrors {
+	var errs ValidationErrors
+	for i, test := range c.Tests {
+		field := fmt.Sprintf("tests[%d]", i)
+		rule, pattern := c.match(test.Namespace, test.VMName)
+		matched := rule >= 0
+
+		var msg string
+		switch {
+		case test.Expect == ExpectMatch && !matched:
+			msg = fmt.Sprintf("expected VM %q in namespace %q to match, but no rule matched", test.VMName, test.Namespace)
+		case test.Expect == ExpectNoMatch && matched:
+			msg = fmt.Sprintf("expected VM %q in namespace %q not to match, but rules[%d] pattern %q matched",
+				test.VMName, test.Namespace, rule, pattern)
+		default:
+			continue
+		}
+		if test.Description != "" {
+			msg = fmt.Sprintf("%s: %s", test.Description, msg)
+		}
+		errs = append(errs, ValidationError{
+			Position: c.position(field),
+			Field:    field,
+			Message:  msg,
+		})
+	}
+	return errs
+}
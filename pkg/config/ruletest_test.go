@@ -0,0 +1,118 @@
+package config_test
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/config"
+)
+
+var _ = Describe("Rule tests", func() {
+	const rules = `
+rules:
+  - namespace: dev
+    patterns:
+      - "^vm-.*"
+`
+
+	parse := func(tests string) (*config.Config, config.ValidationErrors) {
+		cfg, err := config.ParseConfig([]byte(rules + tests))
+		if err == nil {
+			return cfg, nil
+		}
+		var verrs config.ValidationErrors
+		ExpectWithOffset(1, errors.As(err, &verrs)).To(BeTrue())
+		return cfg, verrs
+	}
+
+	It("should load a config whose tests pass", func() {
+		cfg, verrs := parse(`
+tests:
+  - description: dev VMs get nested virt
+    namespace: dev
+    vm-name: vm-builder
+    labels:
+      team: platform
+    expect: match
+  - namespace: dev
+    vm-name: db-1
+    expect: no-match
+  - namespace: prod
+    vm-name: vm-builder
+    expect: no-match
+`)
+		Expect(verrs).To(BeEmpty())
+		Expect(cfg.Tests).To(HaveLen(3))
+		Expect(cfg.Tests[0].Labels).To(HaveKeyWithValue("team", "platform"))
+	})
+
+	It("should report a test expecting a match that does not happen", func() {
+		_, verrs := parse(`
+tests:
+  - namespace: dev
+    vm-name: db-1
+    expect: match
+`)
+		Expect(verrs).To(HaveLen(1))
+		Expect(verrs[0].Field).To(Equal("tests[0]"))
+		Expect(verrs[0].Position).To(Equal(config.Position{Line: 8, Column: 5}))
+		Expect(verrs[0].Message).To(ContainSubstring("no rule matched"))
+	})
+
+	It("should report which rule matched when no match was expected", func() {
+		_, verrs := parse(`
+tests:
+  - description: builders stay flat
+    namespace: dev
+    vm-name: vm-builder
+    expect: no-match
+`)
+		Expect(verrs).To(HaveLen(1))
+		Expect(verrs[0].Message).To(HavePrefix("builders stay flat: "))
+		Expect(verrs[0].Message).To(ContainSubstring(`rules[0] pattern "^vm-.*" matched`))
+	})
+
+	It("should reject malformed tests without running them", func() {
+		_, verrs := parse(`
+tests:
+  - vm-name: vm-builder
+    expect: yes
+`)
+		Expect(verrs).To(HaveLen(2))
+		Expect(verrs[0].Field).To(Equal("tests[0]"))
+		Expect(verrs[0].Message).To(Equal("namespace required"))
+		Expect(verrs[1].Field).To(Equal("tests[0].expect"))
+		Expect(verrs[1].Message).To(ContainSubstring(`got "yes"`))
+	})
+
+	It("should count a match by an empty pattern", func() {
+		_, err := config.ParseConfig([]byte(`
+rules:
+  - namespace: dev
+    patterns: [""]
+tests:
+  - namespace: dev
+    vm-name: vm-builder
+    expect: match
+`))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should not run tests when the rules are invalid", func() {
+		_, err := config.ParseConfig([]byte(`
+rules:
+  - namespace: dev
+    patterns: ["^vm-[.*"]
+tests:
+  - namespace: dev
+    vm-name: vm-builder
+    expect: match
+`))
+		var verrs config.ValidationErrors
+		Expect(errors.As(err, &verrs)).To(BeTrue())
+		Expect(verrs).To(HaveLen(1))
+		Expect(verrs[0].Field).To(Equal("rules[0].patterns[0]"))
+	})
+})
@@ -0,0 +1,111 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// SchemaID is the canonical location of the published configuration schema
+const SchemaID = "https://raw.githubusercontent.com/jaevans/harvester-enable-nested-virt/main/docs/config.schema.json"
+
+// durationPattern matches the durations accepted by time.ParseDuration that
+// ParseConfig accepts too, which leaves out negative ones
+const durationPattern = `^[+]?(0|([0-9]*(\.[0-9]*)?(ns|us|µs|ms|s|m|h))+)$`
+
+// jsonSchema is the subset of JSON Schema (draft 2020-12) that JSONSchema emits
+type jsonSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	ID                   string                 `json:"$id,omitempty"`
+	Ref                  string                 `json:"$ref,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Description          string                 `json:"description,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	Pattern              string                 `json:"pattern,omitempty"`
+	Enum                 []string               `json:"enum,omitempty"`
+	Items                *jsonSchema            `json:"items,omitempty"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	AdditionalProperties any                    `json:"additionalProperties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	Defs                 map[string]*jsonSchema `json:"$defs,omitempty"`
+}
+
+// JSONSchema returns a JSON Schema describing the configuration file. It is
+// generated from the Config type and the types it contains: YAML keys come
+// from the yaml tags, fields without omitempty are required, and the
+// description and enum tags are copied into the schema. Like ParseConfig,
+// the schema rejects unknown fields. Patterns are not given a format: JSON
+// Schema's "regex" format is ECMA-262, not the RE2 syntax the rules use.
+func JSONSchema() ([]byte, error) {
+	defs := map[string]*jsonSchema{}
+	root := structSchema(reflect.TypeOf(Config{}), defs)
+	root.Schema = "https://json-schema.org/draft/2020-12/schema"
+	root.ID = SchemaID
+	root.Title = "harvester-enable-nested-virt configuration"
+	root.Defs = defs
+
+	data, err := json.MarshalIndent(root, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+func structSchema(t reflect.Type, defs map[string]*jsonSchema) *jsonSchema {
+	s := &jsonSchema{
+		Type:                 "object",
+		Properties:           map[string]*jsonSchema{},
+		AdditionalProperties: false,
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, omitempty, ok := yamlName(field)
+		if !ok {
+			continue
+		}
+		prop := typeSchema(field.Type, defs)
+		prop.Description = field.Tag.Get("description")
+		if enum := field.Tag.Get("enum"); enum != "" {
+			prop.Enum = strings.Split(enum, ",")
+		}
+		s.Properties[name] = prop
+		if !omitempty {
+			s.Required = append(s.Required, name)
+		}
+	}
+	return s
+}
+
+// typeSchema returns the schema for a field of type t. Struct types are
+// added to defs once and referenced from there.
+func typeSchema(t reflect.Type, defs map[string]*jsonSchema) *jsonSchema {
+	if t == reflect.TypeOf(time.Duration(0)) {
+		// Durations are written the way time.ParseDuration reads them;
+		// ParseConfig rejects plain numbers
+		return &jsonSchema{Type: "string", Pattern: durationPattern}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return typeSchema(t.Elem(), defs)
+	case reflect.Bool:
+		return &jsonSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &jsonSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &jsonSchema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &jsonSchema{Type: "array", Items: typeSchema(t.Elem(), defs)}
+	case reflect.Map:
+		return &jsonSchema{Type: "object", AdditionalProperties: typeSchema(t.Elem(), defs)}
+	case reflect.Struct:
+		if _, ok := defs[t.Name()]; !ok {
+			defs[t.Name()] = nil // guard against recursive types
+			defs[t.Name()] = structSchema(t, defs)
+		}
+		return &jsonSchema{Ref: "#/$defs/" + t.Name()}
+	default:
+		return &jsonSchema{Type: "string"}
+	}
+}
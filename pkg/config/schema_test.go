@@ -0,0 +1,72 @@
+package config_test
+
+import (
+	"encoding/json"
+	"os"
+	"regexp"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/config"
+)
+
+var _ = Describe("JSONSchema", func() {
+	It("should match the published schema", func() {
+		published, err := os.ReadFile("../../docs/config.schema.json")
+		Expect(err).NotTo(HaveOccurred())
+
+		generated, err := config.JSONSchema()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(generated)).To(Equal(string(published)),
+			"docs/config.schema.json is out of date; run 'make schema'")
+	})
+
+	It("should describe every configuration field and reject unknown ones", func() {
+		generated, err := config.JSONSchema()
+		Expect(err).NotTo(HaveOccurred())
+
+		var schema map[string]any
+		Expect(json.Unmarshal(generated, &schema)).To(Succeed())
+		Expect(schema).To(HaveKeyWithValue("$id", config.SchemaID))
+		Expect(schema).To(HaveKeyWithValue("additionalProperties", false))
+		Expect(schema["properties"]).To(HaveKey("cert-dir"))
+		Expect(schema["properties"]).To(HaveKey("rules"))
+		Expect(schema["properties"]).To(HaveKey("tests"))
+
+		defs := schema["$defs"].(map[string]any)
+		rule := defs["NamespaceRuleConfig"].(map[string]any)
+		Expect(rule["required"]).To(ConsistOf("namespace"))
+		patterns := rule["properties"].(map[string]any)["patterns"].(map[string]any)
+		Expect(patterns["items"]).NotTo(HaveKey("format"))
+		Expect(rule).To(HaveKeyWithValue("additionalProperties", false))
+
+		test := defs["RuleTest"].(map[string]any)
+		expect := test["properties"].(map[string]any)["expect"].(map[string]any)
+		Expect(expect["enum"]).To(ConsistOf(config.ExpectMatch, config.ExpectNoMatch))
+	})
+
+	It("should agree with ParseConfig on what a duration is", func() {
+		generated, err := config.JSONSchema()
+		Expect(err).NotTo(HaveOccurred())
+		var schema map[string]any
+		Expect(json.Unmarshal(generated, &schema)).To(Succeed())
+		drain := schema["properties"].(map[string]any)["drain-period"].(map[string]any)
+		Expect(drain).To(HaveKeyWithValue("type", "string"))
+		pattern := regexp.MustCompile(drain["pattern"].(string))
+
+		_, err = config.ParseConfig([]byte("drain-period: 5s\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pattern.MatchString("5s")).To(BeTrue())
+		_, err = config.ParseConfig([]byte("drain-period: 5\n"))
+		Expect(err).To(MatchError(ContainSubstring("cannot unmarshal !!int")))
+		_, err = config.ParseConfig([]byte("drain-period: -5s\n"))
+		Expect(err).To(MatchError(ContainSubstring("must not be negative")))
+		Expect(pattern.MatchString("-5s")).To(BeFalse())
+	})
+
+	It("should accept a rule without patterns, like ParseConfig", func() {
+		_, err := config.ParseConfig([]byte("rules:\n  - namespace: dev\n"))
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"crypto/tls"
+	"slices"
+)
+
+// TLS versions for tls-min-version
+const (
+	TLSVersion12 = "1.2"
+	TLSVersion13 = "1.3"
+)
+
+// curves maps the names accepted in tls-curve-preferences to their IDs
+var curves = map[string]tls.CurveID{
+	"X25519":         tls.X25519,
+	"P-256":          tls.CurveP256,
+	"P-384":          tls.CurveP384,
+	"P-521":          tls.CurveP521,
+	"X25519MLKEM768": tls.X25519MLKEM768,
+}
+
+// http2CipherSuites are the cipher suites HTTP/2 requires one of
+var http2CipherSuites = [2]string{
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+}
+
+// cipherSuite looks up a TLS 1.2 cipher suite that Go considers secure by
+// its IANA name
+func cipherSuite(name string) (*tls.CipherSuite, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite, slices.Contains(suite.SupportedVersions, tls.VersionTLS12)
+		}
+	}
+	return nil, false
+}
+
+// MinTLSVersion returns the minimum TLS version to accept
+func (c *Config) MinTLSVersion() uint16 {
+	if c.TLSMinVersion == TLSVersion13 {
+		return tls.VersionTLS13
+	}
+	return tls.VersionTLS12
+}
+
+// CipherSuiteIDs returns the IDs of the TLS 1.2 cipher suites to accept, or
+// nil for Go's defaults. Unknown names are skipped; Validate reports them.
+func (c *Config) CipherSuiteIDs() []uint16 {
+	var ids []uint16
+	for _, name := range c.TLSCipherSuites {
+		if suite, ok := cipherSuite(name); ok {
+			ids = append(ids, suite.ID)
+		}
+	}
+	return ids
+}
+
+// CurveIDs returns the IDs of the key exchange curves to offer,
+// in order of preference, or nil for Go's defaults. Unknown names are
+// skipped; Validate reports them.
+func (c *Config) CurveIDs() []tls.CurveID {
+	var ids []tls.CurveID
+	for _, name := range c.TLSCurvePreferences {
+		if id, ok := curves[name]; ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,490 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Position is a location in a YAML document. Line and Column are 1-based;
+// zero means the location is not known.
+type Position struct {
+	Line   int `json:"line,omitempty"`
+	Column int `json:"column,omitempty"`
+}
+
+// ValidationError describes a single problem found in a configuration document
+type ValidationError struct {
+	Position
+	// Field is the path of the offending value, e.g. "rules[0].patterns[1]"
+	Field   string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	var b strings.Builder
+	if e.Line > 0 {
+		fmt.Fprintf(&b, "line %d", e.Line)
+		if e.Column > 0 {
+			fmt.Fprintf(&b, ", column %d", e.Column)
+		}
+		b.WriteString(": ")
+	}
+	if e.Field != "" {
+		b.WriteString(e.Field)
+		b.WriteString(": ")
+	}
+	b.WriteString(e.Message)
+	return b.String()
+}
+
+// ValidationErrors collects every problem found in a configuration document
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ParseConfig strictly parses a YAML configuration document. Syntax errors,
+// unknown fields, values of the wrong type, rules without a namespace,
+// invalid regex patterns and malformed tests are all reported together. If
+// none are found the embedded tests are run and failures are reported the
+// same way. Any error returned is a ValidationErrors, sorted by position.
+// Unless the document is not valid YAML the decoded Config is returned
+// alongside the errors so that tooling such as Lint can still inspect it; it
+// must not be used to serve requests.
+func ParseConfig(data []byte) (*Config, error) {
+	cfg := &Config{positions: map[string]Position{}}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, yamlErrors(err)
+	}
+	if len(doc.Content) == 0 {
+		// Empty document
+		return cfg, nil
+	}
+	root := doc.Content[0]
+
+	// Unknown fields are rejected here rather than with yaml.Decoder.KnownFields
+	// so that each error carries a column as well as a line.
+	errs := checkFields(root, reflect.TypeOf(*cfg), "", cfg.positions)
+	if err := root.Decode(cfg); err != nil {
+		errs = append(errs, yamlErrors(err)...)
+	}
+	errs = append(errs, cfg.checkRules()...)
+	errs = append(errs, cfg.checkSettings()...)
+	errs = append(errs, cfg.checkTests()...)
+	if len(errs) == 0 {
+		// Only run the embedded tests against rules known to be complete
+		errs = cfg.runTests()
+	}
+
+	if len(errs) > 0 {
+		sort.SliceStable(errs, func(i, j int) bool {
+			if errs[i].Line != errs[j].Line {
+				return errs[i].Line < errs[j].Line
+			}
+			return errs[i].Column < errs[j].Column
+		})
+		return cfg, errs
+	}
+	return cfg, nil
+}
+
+// position returns where the value at field was found in the parsed document.
+// Configs that were not produced by ParseConfig have no positions.
+func (c *Config) position(field string) Position {
+	return c.positions[field]
+}
+
+// Validate checks the settings of a config that may have been changed since it
+// was parsed, such as one returned by MergeWithOverrides. It returns
+// ValidationErrors; values that came from the file keep their positions.
+func (c *Config) Validate() error {
+	errs := c.checkSettings()
+	if len(errs) == 0 {
+		return nil
+	}
+	for i, err := range errs {
+		// Point at the environment variable or flag a bad value came from
+		key, _, _ := strings.Cut(err.Field, "[")
+		if src := c.Source(key); src.Kind == SourceEnv || src.Kind == SourceFlag {
+			errs[i].Message = fmt.Sprintf("%s (set by %s)", err.Message, src.Name)
+		}
+	}
+	return errs
+}
+
+// checkSettings reports settings that can be overridden and have invalid
+// values
+func (c *Config) checkSettings() ValidationErrors {
+	errs := c.checkEnums(reflect.ValueOf(c).Elem(), "")
+	errs = append(errs, c.checkDurations()...)
+	if c.MetricsPort != 0 && c.MetricsPort == c.Port {
+		errs = append(errs, ValidationError{
+			Position: c.position("metrics-port"),
+			Field:    "metrics-port",
+			Message:  fmt.Sprintf("must differ from port %d", c.Port),
+		})
+	}
+	if c.MaxRequestBytes < 0 {
+		errs = append(errs, ValidationError{
+			Position: c.position("max-request-bytes"),
+			Field:    "max-request-bytes",
+			Message:  fmt.Sprintf("must not be negative, got %d", c.MaxRequestBytes),
+		})
+	}
+	for _, limit := range []struct {
+		name  string
+		value int
+	}{{"max-in-flight", c.MaxInFlight}, {"max-queue", c.MaxQueue}} {
+		if limit.value < 0 {
+			errs = append(errs, ValidationError{
+				Position: c.position(limit.name),
+				Field:    limit.name,
+				Message:  fmt.Sprintf("must not be negative, got %d", limit.value),
+			})
+		}
+	}
+	if c.MaxQueue > 0 && c.MaxInFlight == 0 {
+		errs = append(errs, ValidationError{
+			Position: c.position("max-queue"),
+			Field:    "max-queue",
+			Message:  "requires max-in-flight",
+		})
+	}
+	if len(c.AllowedClientSubjects) > 0 && c.ClientCAFile == "" {
+		errs = append(errs, ValidationError{
+			Position: c.position("allowed-client-subjects"),
+			Field:    "allowed-client-subjects",
+			Message:  "requires client-ca-file",
+		})
+	}
+	errs = append(errs, c.checkTLS()...)
+	errs = append(errs, c.checkTracing()...)
+	return append(errs, c.checkLabel()...)
+}
+
+// checkTLS reports a bind address that is not an IP address, and cipher
+// suites and curves that are unknown or cannot be used
+func (c *Config) checkTLS() ValidationErrors {
+	var errs ValidationErrors
+	if c.BindAddress != "" && net.ParseIP(c.BindAddress) == nil {
+		errs = append(errs, ValidationError{
+			Position: c.position("bind-address"),
+			Field:    "bind-address",
+			Message:  fmt.Sprintf("must be an IPv4 or IPv6 address, got %q", c.BindAddress),
+		})
+	}
+	if len(c.TLSCipherSuites) > 0 && c.TLSMinVersion == TLSVersion13 {
+		errs = append(errs, ValidationError{
+			Position: c.position("tls-cipher-suites"),
+			Field:    "tls-cipher-suites",
+			Message:  "only apply to TLS 1.2, which tls-min-version 1.3 does not accept",
+		})
+	}
+	for i, name := range c.TLSCipherSuites {
+		if suite, ok := cipherSuite(name); !ok {
+			msg := fmt.Sprintf("unknown or insecure TLS 1.2 cipher suite %q", name)
+			if suite != nil {
+				msg = fmt.Sprintf("%q is a TLS 1.3 cipher suite, which cannot be configured", name)
+			}
+			field := fmt.Sprintf("tls-cipher-suites[%d]", i)
+			errs = append(errs, ValidationError{Position: c.position(field), Field: field, Message: msg})
+		}
+	}
+	if len(c.TLSCipherSuites) > 0 && !slices.Contains(c.TLSCipherSuites, http2CipherSuites[0]) &&
+		!slices.Contains(c.TLSCipherSuites, http2CipherSuites[1]) {
+		errs = append(errs, ValidationError{
+			Position: c.position("tls-cipher-suites"),
+			Field:    "tls-cipher-suites",
+			Message:  fmt.Sprintf("must include %s or %s, which HTTP/2 requires", http2CipherSuites[0], http2CipherSuites[1]),
+		})
+	}
+	for i, name := range c.TLSCurvePreferences {
+		if _, ok := curves[name]; !ok {
+			field := fmt.Sprintf("tls-curve-preferences[%d]", i)
+			errs = append(errs, ValidationError{
+				Position: c.position(field),
+				Field:    field,
+				Message:  fmt.Sprintf("unknown curve %q", name),
+			})
+		}
+	}
+	return errs
+}
+
+// checkTracing reports a tracing endpoint that is not an HTTP URL and a
+// sample ratio that is not a fraction
+func (c *Config) checkTracing() ValidationErrors {
+	var errs ValidationErrors
+	if c.TracingEndpoint != "" {
+		if u, err := url.Parse(c.TracingEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, ValidationError{
+				Position: c.position("tracing-endpoint"),
+				Field:    "tracing-endpoint",
+				Message:  fmt.Sprintf("must be an http or https URL, got %q", c.TracingEndpoint),
+			})
+		}
+	}
+	if c.TracingSampleRatio < 0 || c.TracingSampleRatio > 1 {
+		errs = append(errs, ValidationError{
+			Position: c.position("tracing-sample-ratio"),
+			Field:    "tracing-sample-ratio",
+			Message:  fmt.Sprintf("must be between 0 and 1, got %g", c.TracingSampleRatio),
+		})
+	}
+	return errs
+}
+
+// checkDurations reports top-level durations that are negative
+func (c *Config) checkDurations() ValidationErrors {
+	var errs ValidationErrors
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name, _, ok := yamlName(v.Type().Field(i))
+		if !ok || v.Field(i).Type() != reflect.TypeOf(time.Duration(0)) {
+			continue
+		}
+		if d := time.Duration(v.Field(i).Int()); d < 0 {
+			errs = append(errs, ValidationError{
+				Position: c.position(name),
+				Field:    name,
+				Message:  fmt.Sprintf("must not be negative, got %s", d),
+			})
+		}
+	}
+	return errs
+}
+
+// checkLabel reports a label that is not key=value or that Kubernetes would
+// reject
+func (c *Config) checkLabel() ValidationErrors {
+	key, value, ok := c.MarkerLabel()
+	if !ok {
+		return nil
+	}
+	var msgs []string
+	if !strings.Contains(c.Label, "=") {
+		msgs = append(msgs, "must be key=value")
+	} else {
+		for _, msg := range validation.IsQualifiedName(key) {
+			msgs = append(msgs, "invalid key: "+msg)
+		}
+		for _, msg := range validation.IsValidLabelValue(value) {
+			msgs = append(msgs, "invalid value: "+msg)
+		}
+	}
+	errs := make(ValidationErrors, len(msgs))
+	for i, msg := range msgs {
+		errs[i] = ValidationError{Position: c.position("label"), Field: "label", Message: msg}
+	}
+	return errs
+}
+
+// checkEnums reports optional string fields whose value is not listed in
+// their enum tag. Required enums, such as a test's expect, are checked with a
+// more specific message where they are defined.
+func (c *Config) checkEnums(v reflect.Value, path string) ValidationErrors {
+	var errs ValidationErrors
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			errs = c.checkEnums(v.Elem(), path)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			errs = append(errs, c.checkEnums(v.Index(i), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			name, omitempty, ok := yamlName(field)
+			if !ok {
+				continue
+			}
+			fieldPath := joinField(path, name)
+			value := v.Field(i)
+			enum := field.Tag.Get("enum")
+			if enum != "" && omitempty && value.Kind() == reflect.String && value.String() != "" {
+				allowed := strings.Split(enum, ",")
+				if !slices.Contains(allowed, value.String()) {
+					errs = append(errs, ValidationError{
+						Position: c.position(fieldPath),
+						Field:    fieldPath,
+						Message:  fmt.Sprintf("must be one of %s, got %q", quoteAll(allowed), value.String()),
+					})
+				}
+			}
+			errs = append(errs, c.checkEnums(value, fieldPath)...)
+		}
+	}
+	return errs
+}
+
+func quoteAll(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = strconv.Quote(v)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// checkRules reports rules without a namespace, duplicate rule names and
+// patterns that do not compile
+func (c *Config) checkRules() ValidationErrors {
+	var errs ValidationErrors
+	names := map[string]int{}
+	for i, rule := range c.Rules {
+		if rule.Name != "" {
+			if first, ok := names[rule.Name]; ok {
+				field := fmt.Sprintf("rules[%d].name", i)
+				errs = append(errs, ValidationError{
+					Position: c.position(field),
+					Field:    field,
+					Message:  fmt.Sprintf("name %q is already used by rules[%d]", rule.Name, first),
+				})
+			} else {
+				names[rule.Name] = i
+			}
+		}
+		if rule.Namespace == "" {
+			field := fmt.Sprintf("rules[%d]", i)
+			errs = append(errs, ValidationError{
+				Position: c.position(field),
+				Field:    field,
+				Message:  "namespace is required",
+			})
+		}
+		for j, pattern := range rule.Patterns {
+			if _, err := regexp.Compile(pattern); err != nil {
+				field := fmt.Sprintf("rules[%d].patterns[%d]", i, j)
+				errs = append(errs, ValidationError{
+					Position: c.position(field),
+					Field:    field,
+					Message:  fmt.Sprintf("invalid pattern: %v", err),
+				})
+			}
+		}
+	}
+	return errs
+}
+
+// checkFields walks node alongside the Go type it will be decoded into,
+// recording the position of every value under its field path and reporting
+// mapping keys that do not correspond to a field. Mismatched node kinds are
+// left for the decoder to report.
+func checkFields(node *yaml.Node, t reflect.Type, path string, positions map[string]Position) ValidationErrors {
+	if node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+	positions[path] = Position{Line: node.Line, Column: node.Column}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	var errs ValidationErrors
+	switch {
+	case t.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			field, ok := fields[key.Value]
+			if !ok {
+				errs = append(errs, ValidationError{
+					Position: Position{Line: key.Line, Column: key.Column},
+					Field:    joinField(path, key.Value),
+					Message:  fmt.Sprintf("unknown field %q", key.Value),
+				})
+				continue
+			}
+			errs = append(errs, checkFields(value, field.Type, joinField(path, key.Value), positions)...)
+		}
+	case t.Kind() == reflect.Map && node.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			errs = append(errs, checkFields(node.Content[i+1], t.Elem(), joinField(path, node.Content[i].Value), positions)...)
+		}
+	case t.Kind() == reflect.Slice && node.Kind == yaml.SequenceNode:
+		for i, item := range node.Content {
+			errs = append(errs, checkFields(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i), positions)...)
+		}
+	}
+	return errs
+}
+
+// yamlFields maps the YAML key of each exported field of t to the field
+func yamlFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if name, _, ok := yamlName(field); ok {
+			fields[name] = field
+		}
+	}
+	return fields
+}
+
+// yamlName returns the YAML key of field and whether it is omitempty,
+// following the same naming rules as gopkg.in/yaml.v3. ok is false for
+// fields that are never encoded.
+func yamlName(field reflect.StructField) (name string, omitempty bool, ok bool) {
+	if !field.IsExported() {
+		return "", false, false
+	}
+	name, opts, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	if name == "-" {
+		return "", false, false
+	}
+	if name == "" {
+		name = strings.ToLower(field.Name)
+	}
+	return name, strings.Contains(opts, "omitempty"), true
+}
+
+func joinField(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// yamlErrors converts errors from the yaml package, which carry their line
+// number only in the message text, into ValidationErrors.
+func yamlErrors(err error) ValidationErrors {
+	msgs := []string{strings.TrimPrefix(err.Error(), "yaml: ")}
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		msgs = typeErr.Errors
+	}
+
+	errs := make(ValidationErrors, 0, len(msgs))
+	for _, msg := range msgs {
+		verr := ValidationError{Message: msg}
+		if rest, ok := strings.CutPrefix(msg, "line "); ok {
+			if num, tail, ok := strings.Cut(rest, ": "); ok {
+				if line, err := strconv.Atoi(num); err == nil {
+					verr.Line = line
+					verr.Message = tail
+				}
+			}
+		}
+		errs = append(errs, verr)
+	}
+	return errs
+}
@@ -0,0 +1,78 @@
+package config
+
+import "strings"
+
+// Events that can produce an admission warning
+const (
+	// WarnMutation is returned when a CPU feature is added to a VM
+	WarnMutation = "mutation"
+	// WarnSkip is returned when a VM is left unchanged, either because no
+	// rule selects it or because it already has the feature
+	WarnSkip = "skip"
+	// WarnConflict is returned when a selected VM lists the feature with a
+	// policy that turns it off
+	WarnConflict = "conflict"
+	// WarnError is returned when the webhook fails to handle a VM and
+	// on-error is allow-with-warning
+	WarnError = "error"
+	// WarnShed is returned when the webhook is overloaded and admits a VM
+	// unchanged because shed-policy is allow-with-warning
+	WarnShed = "shed"
+)
+
+// WarningsConfig holds the admission warnings shown to clients such as
+// kubectl and the Harvester UI. Each message may use the placeholders
+// {feature}, {rule}, {namespace}, {name}, {policy}, {reason} and {error}. A
+// message set to "" turns that warning off; one that is not set uses the
+// default.
+type WarningsConfig struct {
+	Mutation *string `yaml:"mutation,omitempty" description:"Warning returned when a CPU feature is added"`
+	Skip     *string `yaml:"skip,omitempty" description:"Warning returned when a VM is left unchanged (off by default)"`
+	Conflict *string `yaml:"conflict,omitempty" description:"Warning returned when a VM turns off the CPU feature itself"`
+	Error    *string `yaml:"error,omitempty" description:"Warning returned when the webhook fails and on-error is allow-with-warning"`
+	Shed     *string `yaml:"shed,omitempty" description:"Warning returned when the webhook is overloaded and shed-policy is allow-with-warning"`
+}
+
+// DefaultWarnings are the messages used for warnings that are not configured
+var DefaultWarnings = map[string]string{
+	WarnMutation: "added cpu feature {feature} (rule {rule})",
+	WarnSkip:     "",
+	WarnConflict: "cpu feature {feature} has policy {policy} and was not changed (rule {rule})",
+	WarnError:    "{error}",
+	WarnShed:     "admitted without nested virtualization: {reason}",
+}
+
+// Warning returns the message template for event, or "" if the warning is
+// turned off
+func (c *Config) Warning(event string) string {
+	if c != nil && c.Warnings != nil {
+		var msg *string
+		switch event {
+		case WarnMutation:
+			msg = c.Warnings.Mutation
+		case WarnSkip:
+			msg = c.Warnings.Skip
+		case WarnConflict:
+			msg = c.Warnings.Conflict
+		case WarnError:
+			msg = c.Warnings.Error
+		case WarnShed:
+			msg = c.Warnings.Shed
+		}
+		if msg != nil {
+			return *msg
+		}
+	}
+	return DefaultWarnings[event]
+}
+
+// ExpandWarning fills the placeholders in a warning template from vars, keyed
+// by placeholder name without braces. Unknown placeholders are left as they
+// are.
+func ExpandWarning(template string, vars map[string]string) string {
+	pairs := make([]string, 0, 2*len(vars))
+	for name, value := range vars {
+		pairs = append(pairs, "{"+name+"}", value)
+	}
+	return strings.NewReplacer(pairs...).Replace(template)
+}
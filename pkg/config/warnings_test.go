@@ -0,0 +1,65 @@
+package config_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/config"
+)
+
+var _ = Describe("Warnings", func() {
+	It("should use the defaults when nothing is configured", func() {
+		var cfg *config.Config
+		Expect(cfg.Warning(config.WarnMutation)).To(Equal(config.DefaultWarnings[config.WarnMutation]))
+
+		cfg = &config.Config{}
+		Expect(cfg.Warning(config.WarnConflict)).To(Equal(config.DefaultWarnings[config.WarnConflict]))
+		Expect(cfg.Warning(config.WarnSkip)).To(BeEmpty())
+	})
+
+	It("should use configured messages and let an empty one turn a warning off", func() {
+		cfg, err := config.ParseConfig([]byte(`
+warnings:
+  mutation: ""
+  skip: "left {name} alone: {reason}"
+`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.Warning(config.WarnMutation)).To(BeEmpty())
+		Expect(cfg.Warning(config.WarnSkip)).To(Equal("left {name} alone: {reason}"))
+		Expect(cfg.Warning(config.WarnError)).To(Equal("{error}"))
+	})
+
+	It("should expand placeholders", func() {
+		Expect(config.ExpandWarning("added cpu feature {feature} (rule {rule}) {unknown}", map[string]string{
+			"feature": "vmx",
+			"rule":    "dev-all",
+		})).To(Equal("added cpu feature vmx (rule dev-all) {unknown}"))
+	})
+
+	Describe("RuleName", func() {
+		It("should use the rule's name or its position", func() {
+			cfg := &config.Config{
+				Rules: []config.NamespaceRuleConfig{
+					{Name: "dev-all", Namespace: "dev"},
+					{Namespace: "prod"},
+				},
+			}
+			Expect(cfg.RuleName(&cfg.Rules[0])).To(Equal("dev-all"))
+			Expect(cfg.RuleName(&cfg.Rules[1])).To(Equal("rules[1]"))
+			Expect(cfg.RuleName(nil)).To(BeEmpty())
+		})
+
+		It("should reject names used by more than one rule", func() {
+			_, err := config.ParseConfig([]byte(`
+rules:
+  - name: dev
+    namespace: dev
+    patterns: [".*"]
+  - name: dev
+    namespace: staging
+    patterns: [".*"]
+`))
+			Expect(err).To(MatchError(`line 6, column 11: rules[1].name: name "dev" is already used by rules[0]`))
+		})
+	})
+})
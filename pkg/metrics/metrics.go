@@ -0,0 +1,156 @@
+// Package metrics defines the webhook's Prometheus metrics.
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// namespace prefixes every metric name
+const namespace = "nested_virt"
+
+// Registry holds every metric the webhook exports
+var Registry = prometheus.NewRegistry()
+
+// Stages of handling an admission request timed by StageDuration
+const (
+	StageDecode = "decode"
+	StageMatch  = "match"
+	StageMutate = "mutate"
+	StagePatch  = "patch"
+)
+
+// Reasons admission requests are shed, counted by Shed
+const (
+	// ShedQueueFull: the limit of requests in flight was reached and the
+	// queue was full
+	ShedQueueFull = "queue_full"
+	// ShedTimeout: the request waited in the queue for as long as it could
+	ShedTimeout = "timeout"
+)
+
+// Results of loading the configuration counted by ConfigLoads
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+var (
+	// Requests counts admission requests by operation, namespace and the
+	// rule that selected the VM, if any, along with the decision, as
+	// recorded in the "action" audit annotation, the mode (enforce or
+	// shadow) and whether the request was a dry run. In shadow mode,
+	// "added" means the feature would have been added. There is a series
+	// for every namespace VMs are created or updated in, not only those
+	// with rules, so clusters with many namespaces pay for it in series.
+	Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "admission_requests_total",
+		Help:      "Admission requests handled, by operation, namespace, rule, decision, mode and whether the request was a dry run.",
+	}, []string{"operation", "namespace", "rule", "decision", "mode", "dry_run"})
+
+	// StageDuration times each stage of handling an admission request
+	StageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "stage_duration_seconds",
+		Help:      "Time taken by each stage of handling an admission request: decode, match, mutate and patch.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 14),
+	}, []string{"stage"})
+
+	// DetectorErrors counts failures to detect the host's CPU
+	// virtualization feature
+	DetectorErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "detector_errors_total",
+		Help:      "Failures to detect the CPU virtualization feature.",
+	})
+
+	// PatchVerificationFailures counts patches that were refused because
+	// applying them to the original VM did not produce the mutated VM
+	PatchVerificationFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "patch_verification_failures_total",
+		Help:      "Patches refused because applying them to the original VM did not produce the mutated VM.",
+	})
+
+	// ConfigLoads counts attempts to load the configuration by result
+	ConfigLoads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "config_loads_total",
+		Help:      "Attempts to load the configuration, by result.",
+	}, []string{"result"})
+
+	// ConfigLastSuccess is when the configuration was last loaded
+	// successfully, as a Unix timestamp
+	ConfigLastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "config_last_success_timestamp_seconds",
+		Help:      "When the configuration was last loaded successfully, in seconds since the epoch.",
+	})
+
+	// InFlight is the number of admission requests being handled
+	InFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "admission_in_flight_requests",
+		Help:      "Admission requests being handled.",
+	})
+
+	// QueueDepth is the number of admission requests waiting for one of
+	// the max-in-flight slots
+	QueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "admission_queue_depth",
+		Help:      "Admission requests waiting for a slot because max-in-flight requests are being handled.",
+	})
+
+	// Shed counts admission requests answered with the shed-policy
+	// decision instead of being handled, by reason
+	Shed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "admission_shed_requests_total",
+		Help:      "Admission requests shed because the webhook was overloaded, by reason: queue_full or timeout.",
+	}, []string{"reason"})
+
+	// CertificateExpiry is when the serving certificate expires, as a Unix
+	// timestamp
+	CertificateExpiry = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "certificate_expiry_timestamp_seconds",
+		Help:      "When the serving certificate expires, in seconds since the epoch.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		Requests,
+		StageDuration,
+		DetectorErrors,
+		PatchVerificationFailures,
+		ConfigLoads,
+		ConfigLastSuccess,
+		CertificateExpiry,
+		InFlight,
+		QueueDepth,
+		Shed,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// ObserveStage records the time taken by stage since start
+func ObserveStage(stage string, start time.Time) {
+	StageDuration.WithLabelValues(stage).Observe(time.Since(start).Seconds())
+}
+
+// RecordConfigLoad counts an attempt to load the configuration that failed
+// with err, or succeeded if err is nil
+func RecordConfigLoad(err error) {
+	if err != nil {
+		ConfigLoads.WithLabelValues(ResultFailure).Inc()
+		return
+	}
+	ConfigLoads.WithLabelValues(ResultSuccess).Inc()
+	ConfigLastSuccess.SetToCurrentTime()
+}
@@ -1,11 +1,15 @@
 package mutation
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"strings"
 
 	kubevirtv1 "kubevirt.io/api/core/v1"
+
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/metrics"
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/tracing"
 )
 
 type CPUFeature string
@@ -17,9 +21,11 @@ const (
 	CPUFeatureSVM = CPUFeature("svm") // AMD-V
 )
 
-// CPUFeatureDetector defines the interface for detecting CPU features
+// CPUFeatureDetector defines the interface for detecting CPU features.
+// Detectors that look the feature up somewhere slow, such as the node
+// inventory, should give up once ctx is done.
 type CPUFeatureDetector interface {
-	DetectFeature() (CPUFeature, error)
+	DetectFeature(ctx context.Context) (CPUFeature, error)
 }
 
 // DefaultCPUFeatureDetector implements CPUFeatureDetector using /proc/cpuinfo
@@ -35,7 +41,10 @@ func NewDefaultCPUFeatureDetector() *DefaultCPUFeatureDetector {
 }
 
 // DetectFeature reads /proc/cpuinfo and returns the appropriate CPU feature
-func (d *DefaultCPUFeatureDetector) DetectFeature() (CPUFeature, error) {
+func (d *DefaultCPUFeatureDetector) DetectFeature(ctx context.Context) (CPUFeature, error) {
+	if err := ctx.Err(); err != nil {
+		return CPUFeatureNil, err
+	}
 	data, err := os.ReadFile(d.cpuInfoPath)
 	if err != nil {
 		return CPUFeatureNil, fmt.Errorf("failed to read %s: %w", d.cpuInfoPath, err)
@@ -75,16 +84,69 @@ func NewVMFeatureMutator(detector CPUFeatureDetector) *VMFeatureMutator {
 	}
 }
 
+// DetectFeature returns the CPU feature the mutator adds to VMs. It returns
+// ctx's error as soon as ctx is done, even if the detector does not.
+func (m *VMFeatureMutator) DetectFeature(ctx context.Context) (CPUFeature, error) {
+	type detection struct {
+		feature CPUFeature
+		err     error
+	}
+	done := make(chan detection, 1)
+	go func() {
+		feature, err := m.detector.DetectFeature(ctx)
+		done <- detection{feature, err}
+	}()
+	select {
+	case d := <-done:
+		return d.feature, d.err
+	case <-ctx.Done():
+		return CPUFeatureNil, ctx.Err()
+	}
+}
+
+// Actions reported in a Result
+const (
+	// ActionAdded means the feature was added to the VM
+	ActionAdded = "added"
+	// ActionPresent means the VM already requested the feature
+	ActionPresent = "present"
+	// ActionConflict means the VM lists the feature with a policy that
+	// turns it off, which is left alone
+	ActionConflict = "conflict"
+)
+
+// Result describes what Mutate did to a VM
+type Result struct {
+	Feature CPUFeature
+	// Action is ActionAdded, ActionPresent or ActionConflict
+	Action string
+	// Policy is the policy of the feature already listed on the VM, if any
+	Policy string
+}
+
 // MutateVM adds the appropriate CPU feature to a VirtualMachine
-func (m *VMFeatureMutator) MutateVM(vm *kubevirtv1.VirtualMachine) error {
+func (m *VMFeatureMutator) MutateVM(ctx context.Context, vm *kubevirtv1.VirtualMachine) error {
+	_, err := m.Mutate(ctx, vm)
+	return err
+}
+
+// Mutate adds the appropriate CPU feature to a VirtualMachine and reports
+// what it did. A feature the VM already lists is never changed, even if its
+// policy disables it. Detecting the feature fails with ctx's error once ctx
+// is done.
+func (m *VMFeatureMutator) Mutate(ctx context.Context, vm *kubevirtv1.VirtualMachine) (Result, error) {
 	if vm == nil {
-		return fmt.Errorf("vm is nil")
+		return Result{}, fmt.Errorf("vm is nil")
 	}
 
-	feature, err := m.detector.DetectFeature()
+	_, span := tracing.Tracer().Start(ctx, tracing.SpanDetect)
+	feature, err := m.DetectFeature(ctx)
+	tracing.End(span, err)
 	if err != nil {
-		return fmt.Errorf("failed to detect CPU feature: %w", err)
+		metrics.DetectorErrors.Inc()
+		return Result{}, fmt.Errorf("failed to detect CPU feature: %w", err)
 	}
+	result := Result{Feature: feature, Action: ActionAdded}
 
 	// Ensure the CPU features structure exists
 	if vm.Spec.Template == nil {
@@ -98,24 +160,26 @@ func (m *VMFeatureMutator) MutateVM(vm *kubevirtv1.VirtualMachine) error {
 	}
 
 	// Check if the feature already exists
-	featureExists := false
 	for _, f := range vm.Spec.Template.Spec.Domain.CPU.Features {
 		if f.Name == string(feature) {
-			featureExists = true
-			break
+			result.Policy = f.Policy
+			if f.Policy == "disable" || f.Policy == "forbid" {
+				result.Action = ActionConflict
+			} else {
+				result.Action = ActionPresent
+			}
+			return result, nil
 		}
 	}
 
 	// Add the feature if it doesn't exist
-	if !featureExists {
-		vm.Spec.Template.Spec.Domain.CPU.Features = append(
-			vm.Spec.Template.Spec.Domain.CPU.Features,
-			kubevirtv1.CPUFeature{
-				Name:   string(feature),
-				Policy: "require",
-			},
-		)
-	}
-
-	return nil
+	vm.Spec.Template.Spec.Domain.CPU.Features = append(
+		vm.Spec.Template.Spec.Domain.CPU.Features,
+		kubevirtv1.CPUFeature{
+			Name:   string(feature),
+			Policy: "require",
+		},
+	)
+
+	return result, nil
 }
@@ -1,6 +1,7 @@
 package mutation
 
 import (
+	"context"
 	"os"
 
 	. "github.com/onsi/ginkgo/v2"
@@ -24,7 +25,7 @@ var _ = Describe("Mutation Internal tests", func() {
 
 			It("should return an error if /proc/cpuinfo cannot be read", func() {
 				invalidDetector := &DefaultCPUFeatureDetector{cpuInfoPath: "/nonexistent/path"}
-				feature, err := invalidDetector.DetectFeature()
+				feature, err := invalidDetector.DetectFeature(context.Background())
 				Expect(err).To(HaveOccurred())
 				Expect(feature).To(BeEquivalentTo(CPUFeatureNil))
 			})
@@ -65,7 +66,7 @@ power management:`
 
 				detector = &DefaultCPUFeatureDetector{cpuInfoPath: fakecpuInfoFile}
 
-				feature, err := detector.DetectFeature()
+				feature, err := detector.DetectFeature(context.Background())
 				Expect(err).NotTo(HaveOccurred())
 				Expect(feature).To(BeEquivalentTo(CPUFeatureVMX))
 			})
@@ -107,7 +108,7 @@ power management: ts ttp tm hwpstate cpb eff_freq_ro [13] [14]
 
 				detector = &DefaultCPUFeatureDetector{cpuInfoPath: fakecpuInfoFile}
 
-				feature, err := detector.DetectFeature()
+				feature, err := detector.DetectFeature(context.Background())
 				Expect(err).NotTo(HaveOccurred())
 				Expect(feature).To(BeEquivalentTo(CPUFeatureSVM))
 			})
@@ -130,7 +131,7 @@ CPU revision	: 3
 
 				detector = &DefaultCPUFeatureDetector{cpuInfoPath: fakecpuInfoFile}
 
-				feature, err := detector.DetectFeature()
+				feature, err := detector.DetectFeature(context.Background())
 				Expect(err).To(HaveOccurred())
 				Expect(feature).To(BeEquivalentTo(CPUFeatureNil))
 			})
@@ -1,12 +1,16 @@
 package mutation_test
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	kubevirtv1 "kubevirt.io/api/core/v1"
 
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/metrics"
 	"github.com/jaevans/harvester-enable-nested-virt/pkg/mutation"
 )
 
@@ -16,10 +20,20 @@ type MockCPUFeatureDetector struct {
 	err     error
 }
 
-func (m *MockCPUFeatureDetector) DetectFeature() (mutation.CPUFeature, error) {
+func (m *MockCPUFeatureDetector) DetectFeature(ctx context.Context) (mutation.CPUFeature, error) {
 	return m.feature, m.err
 }
 
+// stuckDetector never answers, and ignores ctx, until release is closed
+type stuckDetector struct {
+	release chan struct{}
+}
+
+func (d *stuckDetector) DetectFeature(ctx context.Context) (mutation.CPUFeature, error) {
+	<-d.release
+	return mutation.CPUFeatureVMX, nil
+}
+
 var _ = Describe("Mutation", func() {
 	Describe("VMFeatureMutator", func() {
 		Context("when CPU feature is VMX", func() {
@@ -31,7 +45,7 @@ var _ = Describe("Mutation", func() {
 					Spec: kubevirtv1.VirtualMachineSpec{},
 				}
 
-				err := mutator.MutateVM(vm)
+				err := mutator.MutateVM(context.Background(), vm)
 				Expect(err).NotTo(HaveOccurred())
 				Expect(vm.Spec.Template).NotTo(BeNil())
 				Expect(vm.Spec.Template.Spec.Domain.CPU).NotTo(BeNil())
@@ -60,12 +74,67 @@ var _ = Describe("Mutation", func() {
 					},
 				}
 
-				err := mutator.MutateVM(vm)
+				err := mutator.MutateVM(context.Background(), vm)
 				Expect(err).NotTo(HaveOccurred())
 				Expect(vm.Spec.Template.Spec.Domain.CPU.Features).To(HaveLen(1))
 			})
 		})
 
+		Context("when reporting what was done", func() {
+			vmWithFeature := func(policy string) *kubevirtv1.VirtualMachine {
+				return &kubevirtv1.VirtualMachine{
+					Spec: kubevirtv1.VirtualMachineSpec{
+						Template: &kubevirtv1.VirtualMachineInstanceTemplateSpec{
+							Spec: kubevirtv1.VirtualMachineInstanceSpec{
+								Domain: kubevirtv1.DomainSpec{
+									CPU: &kubevirtv1.CPU{
+										Features: []kubevirtv1.CPUFeature{{Name: "vmx", Policy: policy}},
+									},
+								},
+							},
+						},
+					},
+				}
+			}
+
+			It("should give up on detection once the context is done", func() {
+				detector := &stuckDetector{release: make(chan struct{})}
+				DeferCleanup(func() { close(detector.release) })
+				mutator := mutation.NewVMFeatureMutator(detector)
+
+				ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+				defer cancel()
+				vm := &kubevirtv1.VirtualMachine{}
+				_, err := mutator.Mutate(ctx, vm)
+				Expect(err).To(MatchError(context.DeadlineExceeded))
+				Expect(vm.Spec.Template).To(BeNil())
+			})
+
+			It("should report an added feature", func() {
+				mutator := mutation.NewVMFeatureMutator(&MockCPUFeatureDetector{feature: mutation.CPUFeatureVMX})
+				result, err := mutator.Mutate(context.Background(), &kubevirtv1.VirtualMachine{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result).To(Equal(mutation.Result{Feature: mutation.CPUFeatureVMX, Action: mutation.ActionAdded}))
+			})
+
+			DescribeTable("should leave a listed feature alone",
+				func(policy, action string) {
+					mutator := mutation.NewVMFeatureMutator(&MockCPUFeatureDetector{feature: mutation.CPUFeatureVMX})
+					vm := vmWithFeature(policy)
+
+					result, err := mutator.Mutate(context.Background(), vm)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(result).To(Equal(mutation.Result{Feature: mutation.CPUFeatureVMX, Action: action, Policy: policy}))
+					Expect(vm).To(Equal(vmWithFeature(policy)))
+				},
+				Entry("require", "require", mutation.ActionPresent),
+				Entry("no policy", "", mutation.ActionPresent),
+				Entry("optional", "optional", mutation.ActionPresent),
+				Entry("disable", "disable", mutation.ActionConflict),
+				Entry("forbid", "forbid", mutation.ActionConflict),
+			)
+		})
+
 		Context("when CPU feature is SVM", func() {
 			It("should add SVM feature to VM", func() {
 				detector := &MockCPUFeatureDetector{feature: mutation.CPUFeatureSVM}
@@ -75,7 +144,7 @@ var _ = Describe("Mutation", func() {
 					Spec: kubevirtv1.VirtualMachineSpec{},
 				}
 
-				err := mutator.MutateVM(vm)
+				err := mutator.MutateVM(context.Background(), vm)
 				Expect(err).NotTo(HaveOccurred())
 				Expect(vm.Spec.Template).NotTo(BeNil())
 				Expect(vm.Spec.Template.Spec.Domain.CPU).NotTo(BeNil())
@@ -106,7 +175,7 @@ var _ = Describe("Mutation", func() {
 					},
 				}
 
-				err := mutator.MutateVM(vm)
+				err := mutator.MutateVM(context.Background(), vm)
 				Expect(err).NotTo(HaveOccurred())
 				Expect(vm.Spec.Template.Spec.Domain.CPU.Features).To(HaveLen(2))
 				Expect(vm.Spec.Template.Spec.Domain.CPU.Features[0].Name).To(Equal("sse4.2"))
@@ -119,7 +188,7 @@ var _ = Describe("Mutation", func() {
 				detector := &MockCPUFeatureDetector{feature: mutation.CPUFeatureVMX}
 				mutator := mutation.NewVMFeatureMutator(detector)
 
-				err := mutator.MutateVM(nil)
+				err := mutator.MutateVM(context.Background(), nil)
 				Expect(err).To(HaveOccurred())
 			})
 		})
@@ -133,9 +202,11 @@ var _ = Describe("Mutation", func() {
 					Spec: kubevirtv1.VirtualMachineSpec{},
 				}
 
-				err := mutator.MutateVM(vm)
+				errors := testutil.ToFloat64(metrics.DetectorErrors)
+				err := mutator.MutateVM(context.Background(), vm)
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("detection failed"))
+				Expect(testutil.ToFloat64(metrics.DetectorErrors)).To(Equal(errors + 1))
 			})
 		})
 	})
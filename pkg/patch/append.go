@@ -0,0 +1,105 @@
+package patch
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Append returns a patch that appends values to the array at path in the
+// JSON document doc, without replacing anything already there, so it can be
+// combined with patches from other mutating webhooks.
+//
+// If the array exists, each value is added at "-", the end of the array.
+// Otherwise the array and any missing parents are added under the nearest
+// parent that exists. That add would overwrite a member created in the
+// meantime, so it is guarded by a test that the parent is still as it was in
+// doc: a test that a null member is still null, or that the object the
+// member is added to is unchanged.
+func Append(doc []byte, path []string, values ...any) (Patch, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	node, p, err := walk(doc, path, values)
+	if err != nil || p != nil {
+		return p, err
+	}
+
+	if _, ok := node.([]any); !ok {
+		return nil, fmt.Errorf("%s is not an array", Pointer(path...))
+	}
+	end := Pointer(append(path[:len(path):len(path)], "-")...)
+	p = make(Patch, 0, len(values))
+	for _, value := range values {
+		p = append(p, Operation{Op: OpAdd, Path: end, Value: value})
+	}
+	return p, nil
+}
+
+// Set returns a patch that sets members of the object at path in the JSON
+// document doc, leaving its other members alone. Members that already exist
+// are replaced. A missing object is added the same way Append adds a missing
+// array, guarded by a test.
+func Set(doc []byte, path []string, members map[string]any) (Patch, error) {
+	if len(members) == 0 {
+		return nil, nil
+	}
+	node, p, err := walk(doc, path, members)
+	if err != nil || p != nil {
+		return p, err
+	}
+
+	if _, ok := node.(map[string]any); !ok {
+		return nil, fmt.Errorf("%s is not an object", Pointer(path...))
+	}
+	keys := make([]string, 0, len(members))
+	for key := range members {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	p = make(Patch, 0, len(members))
+	for _, key := range keys {
+		member := Pointer(append(path[:len(path):len(path)], key)...)
+		p = append(p, Operation{Op: OpAdd, Path: member, Value: members[key]})
+	}
+	return p, nil
+}
+
+// walk follows path through doc. If every token exists it returns the value
+// at path. Otherwise it returns a guarded patch that creates the missing part
+// of path with leaf at its end.
+func walk(doc []byte, path []string, leaf any) (any, Patch, error) {
+	node, err := decode(doc)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode document: %w", err)
+	}
+
+	for i := range path {
+		obj, ok := node.(map[string]any)
+		if !ok {
+			return nil, nil, fmt.Errorf("%s is not an object", Pointer(path[:i]...))
+		}
+		value, exists := obj[path[i]]
+		switch {
+		case !exists:
+			return nil, Patch{
+				{Op: OpTest, Path: Pointer(path[:i]...), Value: obj},
+				{Op: OpAdd, Path: Pointer(path[:i+1]...), Value: nest(path[i+1:], leaf)},
+			}, nil
+		case value == nil:
+			return nil, Patch{
+				{Op: OpTest, Path: Pointer(path[:i+1]...), Value: nil},
+				{Op: OpReplace, Path: Pointer(path[:i+1]...), Value: nest(path[i+1:], leaf)},
+			}, nil
+		}
+		node = value
+	}
+	return node, nil, nil
+}
+
+// nest wraps leaf in an object for each token of path
+func nest(path []string, leaf any) any {
+	for i := len(path) - 1; i >= 0; i-- {
+		leaf = map[string]any{path[i]: leaf}
+	}
+	return leaf
+}
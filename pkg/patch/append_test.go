@@ -0,0 +1,138 @@
+package patch_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/patch"
+)
+
+var _ = Describe("Append", func() {
+	path := []string{"spec", "cpu", "features"}
+	vmx := map[string]any{"name": "vmx"}
+
+	DescribeTable("should append without replacing existing values",
+		func(doc, expectedPatch, expectedDoc string) {
+			p, err := patch.Append([]byte(doc), path, vmx)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mustMarshal(p)).To(MatchJSON(expectedPatch))
+
+			result, err := patch.Apply([]byte(doc), p)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(MatchJSON(expectedDoc))
+		},
+		Entry("existing array",
+			`{"spec":{"cpu":{"features":[{"name":"pcid"}]}}}`,
+			`[{"op":"add","path":"/spec/cpu/features/-","value":{"name":"vmx"}}]`,
+			`{"spec":{"cpu":{"features":[{"name":"pcid"},{"name":"vmx"}]}}}`),
+		Entry("empty array",
+			`{"spec":{"cpu":{"features":[]}}}`,
+			`[{"op":"add","path":"/spec/cpu/features/-","value":{"name":"vmx"}}]`,
+			`{"spec":{"cpu":{"features":[{"name":"vmx"}]}}}`),
+		Entry("missing array",
+			`{"spec":{"cpu":{"cores":2}}}`,
+			`[
+				{"op":"test","path":"/spec/cpu","value":{"cores":2}},
+				{"op":"add","path":"/spec/cpu/features","value":[{"name":"vmx"}]}
+			]`,
+			`{"spec":{"cpu":{"cores":2,"features":[{"name":"vmx"}]}}}`),
+		Entry("missing parents",
+			`{"spec":{}}`,
+			`[
+				{"op":"test","path":"/spec","value":{}},
+				{"op":"add","path":"/spec/cpu","value":{"features":[{"name":"vmx"}]}}
+			]`,
+			`{"spec":{"cpu":{"features":[{"name":"vmx"}]}}}`),
+		Entry("null parent",
+			`{"spec":null}`,
+			`[
+				{"op":"test","path":"/spec","value":null},
+				{"op":"replace","path":"/spec","value":{"cpu":{"features":[{"name":"vmx"}]}}}
+			]`,
+			`{"spec":{"cpu":{"features":[{"name":"vmx"}]}}}`),
+	)
+
+	It("should refuse to overwrite a member another webhook added", func() {
+		p, err := patch.Append([]byte(`{"spec":{}}`), path, vmx)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = patch.Apply([]byte(`{"spec":{"cpu":{"features":[{"name":"pcid"}]}}}`), p)
+		Expect(err).To(MatchError(patch.ErrTestFailed))
+	})
+
+	It("should keep features another webhook appended", func() {
+		p, err := patch.Append([]byte(`{"spec":{"cpu":{"features":[]}}}`), path, vmx)
+		Expect(err).NotTo(HaveOccurred())
+
+		result, err := patch.Apply([]byte(`{"spec":{"cpu":{"features":[{"name":"pcid"}]}}}`), p)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result).To(MatchJSON(`{"spec":{"cpu":{"features":[{"name":"pcid"},{"name":"vmx"}]}}}`))
+	})
+
+	It("should return an empty patch when there is nothing to append", func() {
+		Expect(patch.Append([]byte(`{}`), path)).To(BeEmpty())
+	})
+
+	DescribeTable("should reject documents where the path cannot hold an array",
+		func(doc string) {
+			_, err := patch.Append([]byte(doc), path, vmx)
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("scalar parent", `{"spec":"invalid"}`),
+		Entry("array parent", `{"spec":[]}`),
+		Entry("not an array", `{"spec":{"cpu":{"features":{}}}}`),
+		Entry("not JSON", `{invalid`),
+	)
+})
+
+var _ = Describe("Set", func() {
+	path := []string{"metadata", "annotations"}
+	members := map[string]any{"b/y": "2", "a": "1"}
+
+	DescribeTable("should set members without replacing the others",
+		func(doc, expectedPatch, expectedDoc string) {
+			p, err := patch.Set([]byte(doc), path, members)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mustMarshal(p)).To(MatchJSON(expectedPatch))
+
+			result, err := patch.Apply([]byte(doc), p)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(MatchJSON(expectedDoc))
+		},
+		Entry("existing object",
+			`{"metadata":{"annotations":{"a":"0","c":"3"}}}`,
+			`[
+				{"op":"add","path":"/metadata/annotations/a","value":"1"},
+				{"op":"add","path":"/metadata/annotations/b~1y","value":"2"}
+			]`,
+			`{"metadata":{"annotations":{"a":"1","b/y":"2","c":"3"}}}`),
+		Entry("missing object",
+			`{"metadata":{"name":"vm"}}`,
+			`[
+				{"op":"test","path":"/metadata","value":{"name":"vm"}},
+				{"op":"add","path":"/metadata/annotations","value":{"a":"1","b/y":"2"}}
+			]`,
+			`{"metadata":{"name":"vm","annotations":{"a":"1","b/y":"2"}}}`),
+		Entry("null object",
+			`{"metadata":{"annotations":null}}`,
+			`[
+				{"op":"test","path":"/metadata/annotations","value":null},
+				{"op":"replace","path":"/metadata/annotations","value":{"a":"1","b/y":"2"}}
+			]`,
+			`{"metadata":{"annotations":{"a":"1","b/y":"2"}}}`),
+	)
+
+	It("should return an empty patch when there is nothing to set", func() {
+		Expect(patch.Set([]byte(`{}`), path, nil)).To(BeEmpty())
+	})
+
+	DescribeTable("should reject documents where the path cannot hold an object",
+		func(doc string) {
+			_, err := patch.Set([]byte(doc), path, members)
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("scalar parent", `{"metadata":"invalid"}`),
+		Entry("not an object", `{"metadata":{"annotations":[]}}`),
+		Entry("not JSON", `{invalid`),
+	)
+})
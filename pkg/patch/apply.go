@@ -0,0 +1,238 @@
+package patch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrTestFailed is returned by Apply when a test operation does not match
+var ErrTestFailed = errors.New("test failed")
+
+// Apply applies the patch to the JSON document doc and returns the result.
+// Operations are applied in order and the first failure aborts the whole
+// patch; doc itself is never modified.
+func Apply(doc []byte, p Patch) ([]byte, error) {
+	value, err := decode(doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode document: %w", err)
+	}
+	for i, op := range p {
+		value, err = applyOperation(value, op)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %w", i, op.Op, op.Path, err)
+		}
+	}
+	return json.Marshal(value)
+}
+
+func applyOperation(doc any, op Operation) (any, error) {
+	path, err := ParsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case OpAdd:
+		return add(doc, path, deepCopy(op.Value))
+	case OpRemove:
+		doc, _, err = remove(doc, path)
+		return doc, err
+	case OpReplace:
+		if _, err := get(doc, path); err != nil {
+			return nil, err
+		}
+		return set(doc, path, deepCopy(op.Value))
+	case OpMove:
+		from, err := ParsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		if op.From == op.Path {
+			_, err := get(doc, from)
+			return doc, err
+		}
+		if strings.HasPrefix(op.Path, op.From+"/") {
+			return nil, fmt.Errorf("cannot move %s into one of its children", op.From)
+		}
+		doc, value, err := remove(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, value)
+	case OpCopy:
+		from, err := ParsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err := get(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, deepCopy(value))
+	case OpTest:
+		value, err := get(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !equal(value, op.Value) {
+			return nil, ErrTestFailed
+		}
+		return doc, nil
+	default:
+		return nil, fmt.Errorf("unknown operation %q", op.Op)
+	}
+}
+
+// get returns the value at path
+func get(doc any, path []string) (any, error) {
+	var err error
+	for i := range path {
+		if doc, err = child(doc, path, i); err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// child returns the member path[i] of doc, which is the value at path[:i]
+func child(doc any, path []string, i int) (any, error) {
+	switch node := doc.(type) {
+	case map[string]any:
+		value, ok := node[path[i]]
+		if !ok {
+			return nil, fmt.Errorf("%s does not exist", Pointer(path[:i+1]...))
+		}
+		return value, nil
+	case []any:
+		index, err := arrayIndex(path[i], len(node), false)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", Pointer(path[:i+1]...), err)
+		}
+		return node[index], nil
+	default:
+		return nil, fmt.Errorf("%s is not an object or array", Pointer(path[:i]...))
+	}
+}
+
+// update replaces the container holding the last token of path with the
+// result of fn, and returns the updated document. Objects are modified in
+// place; arrays may be reallocated, so the new slice is stored back into its
+// parent.
+func update(doc any, path []string, fn func(parent any, token string) (any, error)) (any, error) {
+	return updateAt(doc, path, 0, fn)
+}
+
+// updateAt is update for doc, the value at path[:depth]
+func updateAt(doc any, path []string, depth int, fn func(parent any, token string) (any, error)) (any, error) {
+	if depth == len(path)-1 {
+		return fn(doc, path[depth])
+	}
+	value, err := child(doc, path, depth)
+	if err != nil {
+		return nil, err
+	}
+	if value, err = updateAt(value, path, depth+1, fn); err != nil {
+		return nil, err
+	}
+	switch node := doc.(type) {
+	case map[string]any:
+		node[path[depth]] = value
+	case []any:
+		index, _ := arrayIndex(path[depth], len(node), false)
+		node[index] = value
+	}
+	return doc, nil
+}
+
+func add(doc any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return update(doc, path, func(parent any, token string) (any, error) {
+		switch node := parent.(type) {
+		case map[string]any:
+			node[token] = value
+			return node, nil
+		case []any:
+			index, err := arrayIndex(token, len(node), true)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", Pointer(path...), err)
+			}
+			node = append(node, nil)
+			copy(node[index+1:], node[index:])
+			node[index] = value
+			return node, nil
+		default:
+			return nil, fmt.Errorf("parent of %s is not an object or array", Pointer(path...))
+		}
+	})
+}
+
+func remove(doc any, path []string) (any, any, error) {
+	if len(path) == 0 {
+		return nil, nil, errors.New("cannot remove the whole document")
+	}
+	var removed any
+	doc, err := update(doc, path, func(parent any, token string) (any, error) {
+		switch node := parent.(type) {
+		case map[string]any:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("%s does not exist", Pointer(path...))
+			}
+			removed = value
+			delete(node, token)
+			return node, nil
+		case []any:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", Pointer(path...), err)
+			}
+			removed = node[index]
+			return append(node[:index:index], node[index+1:]...), nil
+		default:
+			return nil, fmt.Errorf("parent of %s is not an object or array", Pointer(path...))
+		}
+	})
+	return doc, removed, err
+}
+
+// set replaces the existing value at path
+func set(doc any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return update(doc, path, func(parent any, token string) (any, error) {
+		switch node := parent.(type) {
+		case map[string]any:
+			node[token] = value
+		case []any:
+			index, _ := arrayIndex(token, len(node), false)
+			node[index] = value
+		}
+		return parent, nil
+	})
+}
+
+// deepCopy copies a decoded JSON value so that later operations on the
+// document cannot change a value shared with the patch or another location
+func deepCopy(v any) any {
+	switch node := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(node))
+		for key, value := range node {
+			out[key] = deepCopy(value)
+		}
+		return out
+	case []any:
+		out := make([]any, len(node))
+		for i, value := range node {
+			out[i] = deepCopy(value)
+		}
+		return out
+	default:
+		return v
+	}
+}
@@ -0,0 +1,129 @@
+package patch_test
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/patch"
+)
+
+var _ = Describe("Apply", func() {
+	apply := func(doc, ops string) ([]byte, error) {
+		p, err := patch.Decode([]byte(ops))
+		ExpectWithOffset(1, err).NotTo(HaveOccurred())
+		return patch.Apply([]byte(doc), p)
+	}
+
+	// Examples from RFC 6902 appendix A
+	DescribeTable("should apply operations",
+		func(doc, ops, expected string) {
+			result, err := apply(doc, ops)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(MatchJSON(expected))
+		},
+		Entry("add an object member",
+			`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`),
+		Entry("add an array element",
+			`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`),
+		Entry("append to an array",
+			`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":"qux"}]`, `{"foo":["bar","qux"]}`),
+		Entry("add a null value",
+			`{}`, `[{"op":"add","path":"/foo","value":null}]`, `{"foo":null}`),
+		Entry("remove an object member",
+			`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`),
+		Entry("remove an array element",
+			`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`),
+		Entry("replace a value",
+			`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`),
+		Entry("replace the whole document",
+			`{"foo":"bar"}`, `[{"op":"replace","path":"","value":[1]}]`, `[1]`),
+		Entry("move a value",
+			`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`,
+			`[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`,
+			`{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`),
+		Entry("move an array element",
+			`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`,
+			`{"foo":["all","cows","eat","grass"]}`),
+		Entry("copy a value",
+			`{"foo":{"bar":1}}`, `[{"op":"copy","from":"/foo","path":"/baz"},{"op":"add","path":"/baz/qux","value":2}]`,
+			`{"foo":{"bar":1},"baz":{"bar":1,"qux":2}}`),
+		Entry("test a value",
+			`{"baz":"qux","foo":["a",2,"c"]}`,
+			`[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`,
+			`{"baz":"qux","foo":["a",2,"c"]}`),
+		Entry("test numbers by value",
+			`{"n":1.0}`, `[{"op":"test","path":"/n","value":1}]`, `{"n":1.0}`),
+		Entry("escaped keys",
+			`{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":10},{"op":"remove","path":"/~1"}]`, `{"~1":10}`),
+		Entry("add to a nested member",
+			`{"foo":"bar"}`, `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`,
+			`{"foo":"bar","child":{"grandchild":{}}}`),
+	)
+
+	DescribeTable("should reject operations that cannot be applied",
+		func(doc, ops, message string) {
+			result, err := apply(doc, ops)
+			Expect(err).To(MatchError(ContainSubstring(message)))
+			Expect(result).To(BeNil())
+		},
+		Entry("add with a missing parent",
+			`{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`, "/baz does not exist"),
+		Entry("remove a missing member",
+			`{"foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, "/baz does not exist"),
+		Entry("replace a missing member",
+			`{"foo":"bar"}`, `[{"op":"replace","path":"/baz","value":1}]`, "/baz does not exist"),
+		Entry("array index out of range",
+			`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/2","value":"qux"}]`, "out of range"),
+		Entry("array index with leading zero",
+			`{"foo":["bar","baz"]}`, `[{"op":"remove","path":"/foo/01"}]`, "invalid array index"),
+		Entry("move into a child",
+			`{"foo":{"bar":1}}`, `[{"op":"move","from":"/foo","path":"/foo/bar/baz"}]`, "into one of its children"),
+		Entry("remove the whole document",
+			`{"foo":"bar"}`, `[{"op":"remove","path":""}]`, "whole document"),
+		Entry("index into a scalar",
+			`{"foo":"bar"}`, `[{"op":"add","path":"/foo/bar/baz","value":1}]`, "/foo is not an object or array"),
+	)
+
+	It("should report failed tests and apply nothing", func() {
+		result, err := apply(`{"baz":"qux"}`, `[{"op":"add","path":"/foo","value":1},{"op":"test","path":"/baz","value":"bar"}]`)
+		Expect(err).To(MatchError(patch.ErrTestFailed))
+		Expect(err.Error()).To(HavePrefix("operation 1 (test /baz)"))
+		Expect(result).To(BeNil())
+	})
+
+	It("should reject documents that are not JSON", func() {
+		_, err := patch.Apply([]byte("{invalid"), nil)
+		Expect(err).To(HaveOccurred())
+	})
+
+	Describe("Decode", func() {
+		DescribeTable("should reject malformed operations",
+			func(ops string) {
+				_, err := patch.Decode([]byte(ops))
+				Expect(err).To(HaveOccurred())
+			},
+			Entry("unknown op", `[{"op":"merge","path":"/a"}]`),
+			Entry("missing path", `[{"op":"remove"}]`),
+			Entry("missing value", `[{"op":"add","path":"/a"}]`),
+			Entry("missing from", `[{"op":"copy","path":"/a"}]`),
+		)
+	})
+
+	Describe("Operation", func() {
+		It("should always encode the value of add, replace and test", func() {
+			data, err := json.Marshal(patch.Patch{
+				{Op: patch.OpAdd, Path: "/a"},
+				{Op: patch.OpRemove, Path: "/b"},
+				{Op: patch.OpMove, From: "/c", Path: "/d"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(data).To(MatchJSON(`[
+				{"op":"add","path":"/a","value":null},
+				{"op":"remove","path":"/b"},
+				{"op":"move","from":"/c","path":"/d"}
+			]`))
+		})
+	})
+})
@@ -0,0 +1,201 @@
+package patch
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+)
+
+// maxLCSCells bounds the table used to diff arrays. Arrays whose changed
+// middle section would need a bigger table are replaced as a whole.
+const maxLCSCells = 1 << 20
+
+// Diff returns a patch that turns the JSON document original into modified.
+// Values that are unchanged are never touched: objects are compared key by
+// key, and arrays element by element after matching up their longest common
+// subsequence, so an element inserted into an array is a single add rather
+// than a replacement of the array. Identical documents give an empty patch.
+func Diff(original, modified []byte) (Patch, error) {
+	a, err := decode(original)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode original document: %w", err)
+	}
+	b, err := decode(modified)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode modified document: %w", err)
+	}
+	return diff(nil, "", a, b), nil
+}
+
+func diff(p Patch, path string, a, b any) Patch {
+	switch av := a.(type) {
+	case map[string]any:
+		if bv, ok := b.(map[string]any); ok {
+			return diffObjects(p, path, av, bv)
+		}
+	case []any:
+		if bv, ok := b.([]any); ok {
+			return diffArrays(p, path, av, bv)
+		}
+	}
+	if !equal(a, b) {
+		p = append(p, Operation{Op: OpReplace, Path: path, Value: b})
+	}
+	return p
+}
+
+func diffObjects(p Patch, path string, a, b map[string]any) Patch {
+	for _, key := range sortedKeys(a) {
+		if _, ok := b[key]; !ok {
+			p = append(p, Operation{Op: OpRemove, Path: path + "/" + EscapeToken(key)})
+		}
+	}
+	for _, key := range sortedKeys(b) {
+		keyPath := path + "/" + EscapeToken(key)
+		if av, ok := a[key]; ok {
+			p = diff(p, keyPath, av, b[key])
+		} else {
+			p = append(p, Operation{Op: OpAdd, Path: keyPath, Value: b[key]})
+		}
+	}
+	return p
+}
+
+func diffArrays(p Patch, path string, a, b []any) Patch {
+	// Elements shared at either end need no further work
+	start := 0
+	for start < len(a) && start < len(b) && equal(a[start], b[start]) {
+		start++
+	}
+	endA, endB := len(a), len(b)
+	for endA > start && endB > start && equal(a[endA-1], b[endB-1]) {
+		endA--
+		endB--
+	}
+	midA, midB := a[start:endA], b[start:endB]
+	if len(midA) == 0 && len(midB) == 0 {
+		return p
+	}
+	if len(midA)*len(midB) > maxLCSCells {
+		return append(p, Operation{Op: OpReplace, Path: path, Value: b})
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of
+	// midA[i:] and midB[j:]
+	lcs := make([][]int, len(midA)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(midB)+1)
+	}
+	for i := len(midA) - 1; i >= 0; i-- {
+		for j := len(midB) - 1; j >= 0; j-- {
+			if equal(midA[i], midB[j]) {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	// Walk the table, collecting each run of removed and inserted elements
+	// between common ones. Within a run, removals and insertions are paired
+	// up and diffed in place; the rest become removes or adds. index tracks
+	// the position in the array as the operations so far have left it.
+	index := start
+	var removed, inserted []any
+	flush := func() {
+		n := min(len(removed), len(inserted))
+		for k := 0; k < n; k++ {
+			p = diff(p, path+"/"+strconv.Itoa(index), removed[k], inserted[k])
+			index++
+		}
+		for range removed[n:] {
+			p = append(p, Operation{Op: OpRemove, Path: path + "/" + strconv.Itoa(index)})
+		}
+		for _, value := range inserted[n:] {
+			p = append(p, Operation{Op: OpAdd, Path: path + "/" + strconv.Itoa(index), Value: value})
+			index++
+		}
+		removed, inserted = removed[:0], inserted[:0]
+	}
+	i, j := 0, 0
+	for i < len(midA) || j < len(midB) {
+		switch {
+		case i < len(midA) && j < len(midB) && equal(midA[i], midB[j]):
+			flush()
+			index++
+			i++
+			j++
+		case j == len(midB) || (i < len(midA) && lcs[i+1][j] >= lcs[i][j+1]):
+			removed = append(removed, midA[i])
+			i++
+		default:
+			inserted = append(inserted, midB[j])
+			j++
+		}
+	}
+	flush()
+	return p
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// equal reports whether two decoded JSON values are equal. Numbers are equal
+// when they have the same value, however they are written.
+func equal(a, b any) bool {
+	switch av := a.(type) {
+	case map[string]any:
+		bv, ok := b.(map[string]any)
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for key, value := range av {
+			other, ok := bv[key]
+			if !ok || !equal(value, other) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		bv, ok := b.([]any)
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !equal(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		switch bv := b.(type) {
+		case json.Number:
+			return av == bv || numbersEqual(string(av), string(bv))
+		case float64:
+			return numbersEqual(string(av), strconv.FormatFloat(bv, 'g', -1, 64))
+		}
+		return false
+	case float64:
+		if bv, ok := b.(json.Number); ok {
+			return equal(bv, av)
+		}
+		bv, ok := b.(float64)
+		return ok && av == bv
+	default:
+		return a == b
+	}
+}
+
+func numbersEqual(a, b string) bool {
+	x, _, errA := big.ParseFloat(a, 10, 256, big.ToNearestEven)
+	y, _, errB := big.ParseFloat(b, 10, 256, big.ToNearestEven)
+	return errA == nil && errB == nil && x.Cmp(y) == 0
+}
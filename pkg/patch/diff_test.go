@@ -0,0 +1,234 @@
+package patch_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/patch"
+)
+
+var _ = Describe("Diff", func() {
+	DescribeTable("should generate minimal patches",
+		func(original, modified string, expected patch.Patch) {
+			p, err := patch.Diff([]byte(original), []byte(modified))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(json.Marshal(p)).To(MatchJSON(mustMarshal(expected)))
+		},
+		Entry("identical documents", `{"a":[1,{"b":2}]}`, `{"a":[1,{"b":2}]}`, patch.Patch(nil)),
+		Entry("numbers written differently", `{"a":1.0}`, `{"a":1}`, patch.Patch(nil)),
+		Entry("added member", `{"a":1}`, `{"a":1,"b":{"c":2}}`, patch.Patch{
+			{Op: patch.OpAdd, Path: "/b", Value: map[string]any{"c": 2}},
+		}),
+		Entry("removed member", `{"a":1,"b":2}`, `{"a":1}`, patch.Patch{
+			{Op: patch.OpRemove, Path: "/b"},
+		}),
+		Entry("changed nested member", `{"a":{"b":1,"c":2}}`, `{"a":{"b":1,"c":3}}`, patch.Patch{
+			{Op: patch.OpReplace, Path: "/a/c", Value: 3},
+		}),
+		Entry("changed type", `{"a":{"b":1}}`, `{"a":[1]}`, patch.Patch{
+			{Op: patch.OpReplace, Path: "/a", Value: []any{1}},
+		}),
+		Entry("null to object", `{"spec":{"template":null}}`, `{"spec":{"template":{"spec":{}}}}`, patch.Patch{
+			{Op: patch.OpReplace, Path: "/spec/template", Value: map[string]any{"spec": map[string]any{}}},
+		}),
+		Entry("missing parent", `{"spec":{}}`, `{"spec":{"template":{"spec":{"cpu":{}}}}}`, patch.Patch{
+			{Op: patch.OpAdd, Path: "/spec/template", Value: map[string]any{"spec": map[string]any{"cpu": map[string]any{}}}},
+		}),
+		Entry("escaped keys", `{"a/b":1,"m~n":2}`, `{"a/b":2}`, patch.Patch{
+			{Op: patch.OpRemove, Path: "/m~0n"},
+			{Op: patch.OpReplace, Path: "/a~1b", Value: 2},
+		}),
+		Entry("element appended", `{"f":[{"name":"a"}]}`, `{"f":[{"name":"a"},{"name":"vmx"}]}`, patch.Patch{
+			{Op: patch.OpAdd, Path: "/f/1", Value: map[string]any{"name": "vmx"}},
+		}),
+		Entry("element inserted", `[1,2,3]`, `[1,4,2,3]`, patch.Patch{
+			{Op: patch.OpAdd, Path: "/1", Value: 4},
+		}),
+		Entry("element removed", `[1,2,3]`, `[1,3]`, patch.Patch{
+			{Op: patch.OpRemove, Path: "/1"},
+		}),
+		Entry("elements removed and inserted", `[1,2,3,4]`, `[0,1,3,5]`, patch.Patch{
+			{Op: patch.OpAdd, Path: "/0", Value: 0},
+			{Op: patch.OpRemove, Path: "/2"},
+			{Op: patch.OpReplace, Path: "/3", Value: 5},
+		}),
+		Entry("element changed in place", `[{"a":1,"b":1}]`, `[{"a":1,"b":2}]`, patch.Patch{
+			{Op: patch.OpReplace, Path: "/0/b", Value: 2},
+		}),
+		Entry("whole document", `1`, `"a"`, patch.Patch{
+			{Op: patch.OpReplace, Path: "", Value: "a"},
+		}),
+	)
+
+	DescribeTable("should reject documents that are not JSON",
+		func(original, modified string) {
+			p, err := patch.Diff([]byte(original), []byte(modified))
+			Expect(err).To(HaveOccurred())
+			Expect(p).To(BeNil())
+		},
+		Entry("invalid original", "{invalid", "{}"),
+		Entry("invalid modified", "{}", "{invalid"),
+		Entry("trailing data", "{} {}", "{}"),
+	)
+
+	Describe("properties", func() {
+		// Each case is generated from its own seed so failures can be
+		// reproduced from the entry's description
+		const cases = 500
+
+		roundTrip := func(a, b []byte) {
+			p, err := patch.Diff(a, b)
+			Expect(err).NotTo(HaveOccurred())
+
+			// The patch survives encoding, as it does in an AdmissionResponse
+			data, err := json.Marshal(p)
+			Expect(err).NotTo(HaveOccurred())
+			decoded, err := patch.Decode(data)
+			Expect(err).NotTo(HaveOccurred())
+
+			result, err := patch.Apply(a, decoded)
+			Expect(err).NotTo(HaveOccurred(), "patch %s", data)
+			Expect(result).To(MatchJSON(b), "patch %s", data)
+		}
+
+		It("should satisfy apply(diff(a, b), a) == b for unrelated documents", func() {
+			for seed := int64(0); seed < cases; seed++ {
+				r := rand.New(rand.NewSource(seed))
+				By(fmt.Sprintf("seed %d", seed))
+				roundTrip(mustMarshal(randomValue(r, 4)), mustMarshal(randomValue(r, 4)))
+			}
+		})
+
+		It("should satisfy apply(diff(a, b), a) == b for edited documents", func() {
+			for seed := int64(0); seed < cases; seed++ {
+				r := rand.New(rand.NewSource(seed))
+				By(fmt.Sprintf("seed %d", seed))
+				a := randomValue(r, 5)
+				b := edit(r, a, 1+r.Intn(5))
+				roundTrip(mustMarshal(a), mustMarshal(b))
+			}
+		})
+
+		It("should produce an empty patch for identical documents", func() {
+			for seed := int64(0); seed < cases; seed++ {
+				r := rand.New(rand.NewSource(seed))
+				doc := mustMarshal(randomValue(r, 5))
+				Expect(patch.Diff(doc, doc)).To(BeEmpty(), "seed %d", seed)
+			}
+		})
+
+		It("should change only what was edited", func() {
+			for seed := int64(0); seed < cases; seed++ {
+				r := rand.New(rand.NewSource(seed))
+				a := map[string]any{"keep": randomValue(r, 3), "edit": randomValue(r, 3)}
+				b := map[string]any{"keep": a["keep"], "edit": edit(r, a["edit"], 1)}
+				p, err := patch.Diff(mustMarshal(a), mustMarshal(b))
+				Expect(err).NotTo(HaveOccurred())
+				for _, op := range p {
+					Expect(op.Path).To(HavePrefix("/edit"), "seed %d", seed)
+				}
+			}
+		})
+	})
+})
+
+func mustMarshal(v any) []byte {
+	data, err := json.Marshal(v)
+	Expect(err).NotTo(HaveOccurred())
+	return data
+}
+
+// keys includes the characters that need escaping in a JSON Pointer and the
+// array append token
+var keys = []string{"a", "b", "c", "spec", "a/b", "m~n", "~1", "-", "0", ""}
+
+func randomValue(r *rand.Rand, depth int) any {
+	kind := r.Intn(7)
+	if depth == 0 {
+		kind = r.Intn(5)
+	}
+	switch kind {
+	case 0:
+		return nil
+	case 1:
+		return r.Intn(2) == 0
+	case 2:
+		return r.Intn(10)
+	case 3:
+		return r.Float64()
+	case 4:
+		return keys[r.Intn(len(keys))]
+	case 5:
+		obj := map[string]any{}
+		for i := r.Intn(5); i > 0; i-- {
+			obj[keys[r.Intn(len(keys))]] = randomValue(r, depth-1)
+		}
+		return obj
+	default:
+		arr := make([]any, r.Intn(6))
+		for i := range arr {
+			arr[i] = randomValue(r, depth-1)
+		}
+		return arr
+	}
+}
+
+// edit returns a copy of v with n random changes: members added, removed or
+// changed, and array elements inserted, removed or changed
+func edit(r *rand.Rand, v any, n int) any {
+	v = copyValue(v)
+	for ; n > 0; n-- {
+		v = editOnce(r, v)
+	}
+	return v
+}
+
+func editOnce(r *rand.Rand, v any) any {
+	switch node := v.(type) {
+	case map[string]any:
+		if len(node) > 0 && r.Intn(3) > 0 {
+			key := sortedKeys(node)[r.Intn(len(node))]
+			if r.Intn(4) == 0 {
+				delete(node, key)
+			} else {
+				node[key] = editOnce(r, node[key])
+			}
+		} else {
+			node[keys[r.Intn(len(keys))]] = randomValue(r, 2)
+		}
+		return node
+	case []any:
+		i := r.Intn(len(node) + 1)
+		switch {
+		case i < len(node) && r.Intn(3) == 0:
+			return append(node[:i], node[i+1:]...)
+		case i < len(node) && r.Intn(2) == 0:
+			node[i] = editOnce(r, node[i])
+			return node
+		default:
+			return append(node[:i], append([]any{randomValue(r, 2)}, node[i:]...)...)
+		}
+	default:
+		return randomValue(r, 2)
+	}
+}
+
+func copyValue(v any) any {
+	var out any
+	Expect(json.Unmarshal(mustMarshal(v), &out)).To(Succeed())
+	return out
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,121 @@
+// Package patch generates and applies JSON Patches (RFC 6902).
+package patch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Patch operations
+const (
+	OpAdd     = "add"
+	OpRemove  = "remove"
+	OpReplace = "replace"
+	OpMove    = "move"
+	OpCopy    = "copy"
+	OpTest    = "test"
+)
+
+// Operation is a single JSON Patch operation
+type Operation struct {
+	Op string `json:"op"`
+	// Path is a JSON Pointer (RFC 6901); build it with Pointer so that keys
+	// containing "~" or "/" are escaped
+	Path string `json:"path"`
+	// From is the source location for move and copy
+	From string `json:"from,omitempty"`
+	// Value is the value for add, replace and test, decoded as by
+	// encoding/json. It is always encoded for those operations, even when
+	// it is nil, because a JSON null is a valid value.
+	Value any `json:"value,omitempty"`
+}
+
+// Patch is a sequence of operations, applied in order
+type Patch []Operation
+
+// hasValue reports whether op carries a value
+func hasValue(op string) bool {
+	return op == OpAdd || op == OpReplace || op == OpTest
+}
+
+// MarshalJSON encodes the operation, including a null value for add, replace
+// and test.
+func (o Operation) MarshalJSON() ([]byte, error) {
+	out := struct {
+		Op    string `json:"op"`
+		Path  string `json:"path"`
+		From  string `json:"from,omitempty"`
+		Value *any   `json:"value,omitempty"`
+	}{Op: o.Op, Path: o.Path, From: o.From}
+	if hasValue(o.Op) {
+		out.Value = &o.Value
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON decodes an operation, rejecting unknown operations and
+// operations missing a member they require.
+func (o *Operation) UnmarshalJSON(data []byte) error {
+	var in struct {
+		Op    string          `json:"op"`
+		Path  *string         `json:"path"`
+		From  *string         `json:"from"`
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+
+	switch in.Op {
+	case OpAdd, OpRemove, OpReplace, OpMove, OpCopy, OpTest:
+	default:
+		return fmt.Errorf("unknown operation %q", in.Op)
+	}
+	if in.Path == nil {
+		return fmt.Errorf("%s operation missing path", in.Op)
+	}
+	if (in.Op == OpMove || in.Op == OpCopy) && in.From == nil {
+		return fmt.Errorf("%s operation missing from", in.Op)
+	}
+	if hasValue(in.Op) && in.Value == nil {
+		return fmt.Errorf("%s operation missing value", in.Op)
+	}
+
+	*o = Operation{Op: in.Op, Path: *in.Path}
+	if in.From != nil {
+		o.From = *in.From
+	}
+	if in.Value != nil {
+		value, err := decode(in.Value)
+		if err != nil {
+			return err
+		}
+		o.Value = value
+	}
+	return nil
+}
+
+// Decode parses a JSON Patch document
+func Decode(data []byte) (Patch, error) {
+	var p Patch
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to decode patch: %w", err)
+	}
+	return p, nil
+}
+
+// decode parses a JSON document, keeping numbers as json.Number so that they
+// survive a round trip unchanged.
+func decode(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected data after JSON value")
+	}
+	return v, nil
+}
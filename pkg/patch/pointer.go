@@ -0,0 +1,74 @@
+package patch
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	escaper   = strings.NewReplacer("~", "~0", "/", "~1")
+	unescaper = strings.NewReplacer("~1", "/", "~0", "~")
+)
+
+// EscapeToken escapes a single reference token (an object key or array
+// index) for use in a JSON Pointer
+func EscapeToken(token string) string {
+	return escaper.Replace(token)
+}
+
+// UnescapeToken reverses EscapeToken
+func UnescapeToken(token string) string {
+	return unescaper.Replace(token)
+}
+
+// Pointer builds a JSON Pointer from unescaped reference tokens. With no
+// tokens it returns "", the pointer to the whole document.
+func Pointer(tokens ...string) string {
+	var b strings.Builder
+	for _, token := range tokens {
+		b.WriteByte('/')
+		b.WriteString(EscapeToken(token))
+	}
+	return b.String()
+}
+
+// ParsePointer splits a JSON Pointer into its unescaped reference tokens
+func ParsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if pointer[0] != '/' {
+		return nil, fmt.Errorf("invalid JSON pointer %q: must be empty or start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		for j := 0; j < len(token); j++ {
+			if token[j] == '~' && (j+1 == len(token) || (token[j+1] != '0' && token[j+1] != '1')) {
+				return nil, fmt.Errorf("invalid JSON pointer %q: ~ must be followed by 0 or 1", pointer)
+			}
+		}
+		tokens[i] = UnescapeToken(token)
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses token as an index into an array of length n. When
+// appending, "-" and n itself are accepted as the position after the last
+// element.
+func arrayIndex(token string, n int, appending bool) (int, error) {
+	if appending && token == "-" {
+		return n, nil
+	}
+	if token == "" || (len(token) > 1 && token[0] == '0') || strings.TrimLeft(token, "0123456789") != "" {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if i > n || (i == n && !appending) {
+		return 0, fmt.Errorf("array index %d out of range", i)
+	}
+	return i, nil
+}
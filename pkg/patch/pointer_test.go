@@ -0,0 +1,48 @@
+package patch_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/patch"
+)
+
+var _ = Describe("Pointer", func() {
+	DescribeTable("should escape and unescape reference tokens",
+		func(token, escaped string) {
+			Expect(patch.EscapeToken(token)).To(Equal(escaped))
+			Expect(patch.UnescapeToken(escaped)).To(Equal(token))
+		},
+		Entry("plain key", "features", "features"),
+		Entry("slash", "a/b", "a~1b"),
+		Entry("tilde", "m~n", "m~0n"),
+		Entry("tilde before one", "~1", "~01"),
+		Entry("annotation key", "nested-virt.jaevans.io/enabled", "nested-virt.jaevans.io~1enabled"),
+	)
+
+	It("should build pointers from tokens", func() {
+		Expect(patch.Pointer()).To(Equal(""))
+		Expect(patch.Pointer("metadata", "annotations", "a/b")).To(Equal("/metadata/annotations/a~1b"))
+		Expect(patch.Pointer("")).To(Equal("/"))
+	})
+
+	DescribeTable("should parse pointers",
+		func(pointer string, tokens []string) {
+			Expect(patch.ParsePointer(pointer)).To(Equal(tokens))
+		},
+		Entry("whole document", "", nil),
+		Entry("empty key", "/", []string{""}),
+		Entry("nested", "/spec/template/0", []string{"spec", "template", "0"}),
+		Entry("escaped", "/a~1b/m~0n", []string{"a/b", "m~n"}),
+	)
+
+	DescribeTable("should reject invalid pointers",
+		func(pointer string) {
+			_, err := patch.ParsePointer(pointer)
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("relative", "spec"),
+		Entry("bad escape", "/a~2"),
+		Entry("trailing tilde", "/a~"),
+	)
+})
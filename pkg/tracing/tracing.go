@@ -0,0 +1,90 @@
+// Package tracing sets up OpenTelemetry tracing of admission requests.
+// Spans are always created through Tracer, and go nowhere until Setup, or
+// tracingtest.InMemory in tests, installs a TracerProvider.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ServiceName identifies the webhook in exported traces
+const ServiceName = "harvester-enable-nested-virt"
+
+// instrumentationName is the name of the tracer spans are created with
+const instrumentationName = "github.com/jaevans/harvester-enable-nested-virt"
+
+// Names of the spans created for an admission request: the request span,
+// a child span for each stage of handling it, and SpanDetect below
+// SpanMutate
+const (
+	SpanRequest = "admission"
+	SpanDecode  = "decode"
+	SpanMatch   = "match"
+	SpanMutate  = "mutate"
+	SpanPatch   = "patch"
+	SpanDetect  = "detect"
+)
+
+// Attributes set on the request span
+const (
+	AttrUID       = "k8s.admission.uid"
+	AttrOperation = "k8s.admission.operation"
+	AttrDryRun    = "k8s.admission.dry_run"
+	AttrNamespace = "k8s.namespace.name"
+	AttrVMName    = "kubevirt.vm.name"
+	AttrRule      = "nested_virt.rule"
+	AttrMode      = "nested_virt.mode"
+	AttrDecision  = "nested_virt.decision"
+)
+
+// Tracer returns the tracer admission request spans are created with
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Setup exports spans to the OTLP/HTTP endpoint, a URL such as
+// http://otel-collector:4318, sampling sampleRatio of the requests that do
+// not carry a sampling decision from the API server in their traceparent
+// header. The OTEL_EXPORTER_OTLP_* environment variables, e.g. for headers,
+// are honoured. The returned function flushes the spans not yet exported
+// and stops tracing.
+func Setup(ctx context.Context, endpoint string, sampleRatio float64, version string) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(ServiceName),
+		semconv.ServiceVersion(version),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe the tracing resource: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// End ends span, marking it as failed with err if err is not nil
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
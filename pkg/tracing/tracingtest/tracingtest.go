@@ -0,0 +1,29 @@
+// Package tracingtest records the spans created through tracing.Tracer in
+// memory, for tests.
+package tracingtest
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// InMemory records every span in the returned exporter instead of
+// exporting them. Spans are recorded as soon as they end, and traceparent
+// headers are honoured as they are by tracing.Setup. The returned function
+// restores the TracerProvider and propagator in use before.
+func InMemory() (*tracetest.InMemoryExporter, func()) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous, previousPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return exporter, func() {
+		otel.SetTracerProvider(previous)
+		otel.SetTextMapPropagator(previousPropagator)
+		_ = provider.Shutdown(context.Background())
+	}
+}
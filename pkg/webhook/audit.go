@@ -0,0 +1,33 @@
+package webhook
+
+import "github.com/jaevans/harvester-enable-nested-virt/pkg/config"
+
+// Actions recorded in the "action" audit annotation
+const (
+	actionAdded    = "added"
+	actionSkipped  = "skipped"
+	actionConflict = "conflict"
+	actionError    = "error"
+	actionShed     = "shed"
+)
+
+// auditAnnotations records a decision in the API server's audit log. The API
+// server prefixes each key with the name of the webhook, so the log shows
+// e.g. "nested-virt.jaevans.io/action": "added". action and reason are always
+// set; rule and feature only once they are known, and mode only in shadow
+// mode, where the action was not actually taken.
+func auditAnnotations(action string, vars map[string]string) map[string]string {
+	annotations := map[string]string{
+		"action": action,
+		"reason": vars["reason"],
+	}
+	for _, key := range []string{"rule", "feature"} {
+		if value := vars[key]; value != "" {
+			annotations[key] = value
+		}
+	}
+	if vars["mode"] == config.ModeShadow {
+		annotations["mode"] = config.ModeShadow
+	}
+	return annotations
+}
@@ -0,0 +1,173 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/metrics"
+)
+
+const (
+	// certPollInterval is how often Wait checks for the certificate files
+	certPollInterval = 500 * time.Millisecond
+	// certResyncInterval is how often Watch reloads the certificate even
+	// without a file event, in case one was missed
+	certResyncInterval = time.Minute
+)
+
+// errNoCertificate is returned by GetCertificate before a certificate has
+// been loaded
+var errNoCertificate = errors.New("no TLS certificate loaded")
+
+// certificateStatus describes the serving certificate
+type certificateStatus struct {
+	// NotAfter is when the certificate in use expires; it is zero if none
+	// has been loaded
+	NotAfter time.Time
+	// Err is why the last attempt to load the certificate failed, or nil if
+	// it succeeded
+	Err error
+}
+
+// certLoader serves the certificate in certFile and keyFile, reloading it
+// when the files change. Renewals by cert-manager replace both files in the
+// mounted Secret at once; a pair that fails to load, for example because only
+// one file has been replaced so far, leaves the previous certificate in use.
+type certLoader struct {
+	certFile string
+	keyFile  string
+
+	cert atomic.Pointer[tls.Certificate]
+
+	mu  sync.Mutex
+	err error
+}
+
+func newCertLoader(certFile, keyFile string) *certLoader {
+	return &certLoader{certFile: certFile, keyFile: keyFile}
+}
+
+// GetCertificate returns the current certificate, for tls.Config
+func (l *certLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := l.cert.Load(); cert != nil {
+		return cert, nil
+	}
+	return nil, errNoCertificate
+}
+
+// Load reads the certificate files and, if they hold a valid pair, swaps
+// the new certificate in. It reports whether the certificate changed.
+func (l *certLoader) Load() (bool, error) {
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	l.mu.Lock()
+	l.err = err
+	l.mu.Unlock()
+	if err != nil {
+		return false, err
+	}
+
+	old := l.cert.Swap(&cert)
+	if cert.Leaf != nil {
+		metrics.CertificateExpiry.Set(float64(cert.Leaf.NotAfter.Unix()))
+	}
+	return old == nil || !bytes.Equal(old.Certificate[0], cert.Certificate[0]), nil
+}
+
+// Wait loads the certificate, retrying until the files appear or timeout
+// passes. It returns the last error if no certificate could be loaded.
+func (l *certLoader) Wait(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(certPollInterval)
+	defer ticker.Stop()
+
+	for waited := false; ; waited = true {
+		_, err := l.Load()
+		if err == nil {
+			return nil
+		}
+		if !waited {
+			slog.Info("Waiting for TLS certificate", "certFile", l.certFile, "keyFile", l.keyFile, "timeout", timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("no valid certificate after %s: %w", timeout, err)
+		case <-ticker.C:
+		}
+	}
+}
+
+// Watch reloads the certificate whenever a file in the directories holding
+// it changes, and every certResyncInterval, until ctx is done
+func (l *certLoader) Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to watch certificates: %w", err)
+	}
+	defer watcher.Close() //nolint:errcheck
+
+	// Secrets are mounted through symlinks that are swapped on update, so
+	// watch the directories rather than the files
+	dirs := map[string]bool{filepath.Dir(l.certFile): true, filepath.Dir(l.keyFile): true}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			return fmt.Errorf("failed to watch %s: %w", dir, err)
+		}
+	}
+
+	ticker := time.NewTicker(certResyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op != fsnotify.Chmod {
+				l.reload()
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			slog.Warn("Error watching TLS certificate", "error", err)
+		case <-ticker.C:
+			l.reload()
+		}
+	}
+}
+
+// reload loads the certificate and logs the outcome
+func (l *certLoader) reload() {
+	changed, err := l.Load()
+	switch {
+	case err != nil:
+		slog.Warn("Failed to reload TLS certificate, keeping the current one", "certFile", l.certFile, "error", err)
+	case changed:
+		slog.Info("Reloaded TLS certificate", "certFile", l.certFile, "notAfter", l.Status().NotAfter)
+	}
+}
+
+// Status describes the certificate in use and the last attempt to load it
+func (l *certLoader) Status() certificateStatus {
+	var status certificateStatus
+	if cert := l.cert.Load(); cert != nil && cert.Leaf != nil {
+		status.NotAfter = cert.Leaf.NotAfter
+	}
+	l.mu.Lock()
+	status.Err = l.err
+	l.mu.Unlock()
+	return status
+}
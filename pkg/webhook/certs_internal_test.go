@@ -0,0 +1,72 @@
+package webhook
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("certLoader", func() {
+	var (
+		certFile string
+		keyFile  string
+		loader   *certLoader
+	)
+
+	BeforeEach(func() {
+		dir := GinkgoT().TempDir()
+		certFile = filepath.Join(dir, "tls.crt")
+		keyFile = filepath.Join(dir, "tls.key")
+		loader = newCertLoader(certFile, keyFile)
+	})
+
+	write := func(cert, key []byte) {
+		Expect(os.WriteFile(certFile, cert, 0600)).To(Succeed())
+		Expect(os.WriteFile(keyFile, key, 0600)).To(Succeed())
+	}
+
+	It("should have no certificate until one is loaded", func() {
+		_, err := loader.GetCertificate(nil)
+		Expect(err).To(MatchError(errNoCertificate))
+
+		_, err = loader.Load()
+		Expect(err).To(HaveOccurred())
+		Expect(loader.Status().NotAfter).To(BeZero())
+		Expect(loader.Status().Err).To(HaveOccurred())
+	})
+
+	It("should keep the current certificate when a reload fails", func() {
+		write(testCert, testKey)
+		changed, err := loader.Load()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(changed).To(BeTrue())
+		current, err := loader.GetCertificate(nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		// Only the certificate has been replaced so far
+		newCert, _ := generateTestCertificates()
+		Expect(os.WriteFile(certFile, newCert, 0600)).To(Succeed())
+		_, err = loader.Load()
+		Expect(err).To(HaveOccurred())
+
+		Expect(loader.GetCertificate(nil)).To(BeIdenticalTo(current))
+		Expect(loader.Status().NotAfter).NotTo(BeZero())
+		Expect(loader.Status().Err).To(HaveOccurred())
+	})
+
+	It("should report whether the certificate changed", func() {
+		write(testCert, testKey)
+		Expect(loader.Load()).To(BeTrue())
+		Expect(loader.Load()).To(BeFalse())
+	})
+
+	It("should give up waiting after the timeout", func() {
+		start := time.Now()
+		err := loader.Wait(GinkgoT().Context(), 200*time.Millisecond)
+		Expect(err).To(MatchError(ContainSubstring("no valid certificate after 200ms")))
+		Expect(time.Since(start)).To(BeNumerically(">=", 200*time.Millisecond))
+	})
+})
@@ -1,20 +1,35 @@
 package webhook
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"mime"
 	"net/http"
-
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 	kubevirtv1 "kubevirt.io/api/core/v1"
 
 	"github.com/jaevans/harvester-enable-nested-virt/pkg/config"
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/metrics"
 	"github.com/jaevans/harvester-enable-nested-virt/pkg/mutation"
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/patch"
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/tracing"
 )
 
 var (
@@ -25,61 +40,118 @@ var (
 func init() {
 	_ = kubevirtv1.AddToScheme(scheme)
 	_ = admissionv1.AddToScheme(scheme)
+	_ = admissionv1beta1.AddToScheme(scheme)
 }
 
-// WebhookHandler handles admission webhook requests
+// WebhookHandler handles admission webhook requests. Dry-run requests get
+// the same response as any other, but are labeled as dry runs in logs and
+// metrics, and skip the side effects, which only run through
+// runSideEffects.
 type WebhookHandler struct {
-	config  *config.Config
-	mutator *mutation.VMFeatureMutator
+	config      *config.Config
+	matcher     Matcher
+	mutator     *mutation.VMFeatureMutator
+	limiter     *limiter
+	sideEffects []sideEffect
+}
+
+// Matcher selects the rule that applies to a VM, if any, and the pattern
+// that matched. Matchers that look at slow sources, such as namespace
+// labels, should give up once ctx is done. *config.Config is a Matcher.
+type Matcher interface {
+	MatchVM(ctx context.Context, namespace, name string) (*config.NamespaceRuleConfig, string, error)
 }
 
+// defaultAdmissionTimeout is the API server's default timeoutSeconds, used
+// when a request does not carry a timeout
+const defaultAdmissionTimeout = 10 * time.Second
+
 // NewWebhookHandler creates a new WebhookHandler
 func NewWebhookHandler(cfg *config.Config, mutator *mutation.VMFeatureMutator) *WebhookHandler {
-	return &WebhookHandler{
+	h := &WebhookHandler{
 		config:  cfg,
+		matcher: cfg,
 		mutator: mutator,
 	}
+	if cfg != nil {
+		h.limiter = newLimiter(cfg.MaxInFlight, cfg.MaxQueue, cfg.MaxQueueWait)
+	} else {
+		h.limiter = newLimiter(0, 0, 0)
+	}
+	return h
 }
 
-// Handle processes admission webhook requests
+// Handle processes admission webhook requests. Each request is traced in a
+// span of its own, which continues the API server's trace if the request
+// carries a traceparent header.
 func (h *WebhookHandler) Handle(w http.ResponseWriter, r *http.Request) {
 	slog.Debug("Received webhook request", "method", r.Method, "path", r.URL.Path)
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracing.Tracer().Start(ctx, tracing.SpanRequest, trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		w.Header().Set("Allow", http.MethodPost)
+		writeReviewError(ctx, w, nil, http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed, "method not allowed")
+		return
+	}
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		writeReviewError(ctx, w, nil, http.StatusUnsupportedMediaType, metav1.StatusReasonUnsupportedMediaType,
+			fmt.Sprintf("unsupported content type %q, expected application/json", r.Header.Get("Content-Type")))
 		return
 	}
 
-	body, err := io.ReadAll(r.Body)
+	limit := h.config.RequestBytesLimit()
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
 	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to read request body: %v", err), http.StatusBadRequest)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeReviewError(ctx, w, nil, http.StatusRequestEntityTooLarge, metav1.StatusReasonRequestEntityTooLarge,
+				fmt.Sprintf("request body is larger than %d bytes", limit))
+			return
+		}
+		writeReviewError(ctx, w, nil, http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("failed to read request body: %v", err))
 		return
 	}
 	defer r.Body.Close()
 
 	// Decode the admission review request
-	admissionReview := &admissionv1.AdmissionReview{}
-	deserializer := codecs.UniversalDeserializer()
-	if _, _, err := deserializer.Decode(body, nil, admissionReview); err != nil {
-		http.Error(w, fmt.Sprintf("failed to decode admission review: %v", err), http.StatusBadRequest)
+	admissionReview, err := decodeAdmissionReview(body)
+	if err != nil {
+		writeReviewError(ctx, w, nil, http.StatusBadRequest, metav1.StatusReasonBadRequest, fmt.Sprintf("failed to decode admission review: %v", err))
 		return
 	}
 
-	if admissionReview.Request == nil {
-		http.Error(w, "admission review request is nil", http.StatusBadRequest)
+	if admissionReview.request == nil {
+		writeReviewError(ctx, w, admissionReview, http.StatusBadRequest, metav1.StatusReasonBadRequest, "admission review request is nil")
 		return
 	}
+	req := admissionReview.request
+	span.SetAttributes(
+		attribute.String(tracing.AttrUID, string(req.UID)),
+		attribute.String(tracing.AttrOperation, string(req.Operation)),
+		attribute.String(tracing.AttrNamespace, req.Namespace),
+		attribute.Bool(tracing.AttrDryRun, req.DryRun != nil && *req.DryRun),
+	)
+
+	// Process the request, unless the webhook is too busy to. Leave a fifth
+	// of the API server's timeout for the response to get back to it.
+	timeout := admissionTimeout(r)
+	ctx, cancel := context.WithTimeout(ctx, timeout*4/5)
+	defer cancel()
+	var response *admissionv1.AdmissionResponse
+	if release, reason := h.limiter.acquire(ctx, timeout); release != nil {
+		response = h.mutate(ctx, req)
+		release()
+	} else {
+		response = h.shed(ctx, req, reason)
+	}
+	response.UID = req.UID
 
-	// Process the request
-	response := h.mutate(admissionReview.Request)
-
-	// Construct the response
-	admissionReview.Response = response
-	admissionReview.Response.UID = admissionReview.Request.UID
-
-	// Encode and send the response
-	responseBytes, err := json.Marshal(admissionReview)
+	// Encode and send the response in the version of the request
+	responseBytes, err := admissionReview.encodeResponse(response)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
+		writeReviewError(ctx, w, admissionReview, http.StatusInternalServerError, metav1.StatusReasonInternalError, fmt.Sprintf("failed to encode response: %v", err))
 		return
 	}
 
@@ -88,174 +160,403 @@ func (h *WebhookHandler) Handle(w http.ResponseWriter, r *http.Request) {
 	w.Write(responseBytes) //nolint:errcheck
 }
 
-// mutate processes the admission request and returns an admission response
-func (h *WebhookHandler) mutate(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
-	response := &admissionv1.AdmissionResponse{
+// admissionTimeout returns the time the API server gives the webhook to
+// respond, which it passes in the "timeout" query parameter
+func admissionTimeout(r *http.Request) time.Duration {
+	if timeout, err := time.ParseDuration(r.URL.Query().Get("timeout")); err == nil && timeout > 0 {
+		return timeout
+	}
+	return defaultAdmissionTimeout
+}
+
+// mutate processes the admission request and returns an admission response.
+// Matching and mutating the VM give up when ctx is done, and the request is
+// then handled according to on-error.
+func (h *WebhookHandler) mutate(ctx context.Context, req *admissionv1.AdmissionRequest) (response *admissionv1.AdmissionResponse) {
+	dryRun := req.DryRun != nil && *req.DryRun
+	log := slog.Default()
+	if dryRun {
+		log = log.With("dryRun", true)
+	}
+	// vars fill the placeholders in warnings and the audit annotations
+	vars := map[string]string{"namespace": req.Namespace, "name": req.Name, "mode": h.config.ModeFor(nil)}
+	defer func() {
+		record(ctx, req, response, vars, dryRun)
+		h.runSideEffects(ctx, log, req, response, dryRun)
+	}()
+
+	response = &admissionv1.AdmissionResponse{
 		Allowed: true,
 	}
 
 	// Parse the VirtualMachine object
 	vm := &kubevirtv1.VirtualMachine{}
 	deserializer := codecs.UniversalDeserializer()
-	if _, _, err := deserializer.Decode(req.Object.Raw, nil, vm); err != nil {
-		response.Result = &metav1.Status{
-			Message: fmt.Sprintf("failed to decode VirtualMachine: %v", err),
-		}
-		return response
+	start := time.Now()
+	_, span := tracing.Tracer().Start(ctx, tracing.SpanDecode)
+	_, _, err := deserializer.Decode(req.Object.Raw, nil, vm)
+	tracing.End(span, err)
+	metrics.ObserveStage(metrics.StageDecode, start)
+	if err != nil {
+		return h.failure(log, nil, vars, http.StatusBadRequest, metav1.StatusReasonBadRequest,
+			fmt.Sprintf("failed to decode VirtualMachine: %v", err))
 	}
+	vars["name"] = vm.Name
 
-	slog.Debug("Processing VM", "namespace", req.Namespace, "name", vm.Name, "operation", req.Operation)
+	log.Debug("Processing VM", "namespace", req.Namespace, "name", vm.Name, "operation", req.Operation)
 
 	// Check if the VM matches any rule
-	matches := h.config.Matches(req.Namespace, vm.Name)
-	slog.Debug("Checking VM against rules", "namespace", req.Namespace, "name", vm.Name, "matches", matches)
-	if !matches {
+	start = time.Now()
+	matchCtx, span := tracing.Tracer().Start(ctx, tracing.SpanMatch)
+	rule, pattern, err := h.matcher.MatchVM(matchCtx, req.Namespace, vm.Name)
+	tracing.End(span, err)
+	metrics.ObserveStage(metrics.StageMatch, start)
+	if err != nil {
+		code, reason := failureStatus(err)
+		return h.failure(log, nil, vars, code, reason, fmt.Sprintf("failed to match VirtualMachine against rules: %v", err))
+	}
+	log.Debug("Checking VM against rules", "namespace", req.Namespace, "name", vm.Name, "matches", rule != nil)
+	if rule == nil {
 		// No match, allow without modification
-		slog.Debug("VM does not match any rules, skipping mutation")
+		log.Debug("VM does not match any rules, skipping mutation")
+		vars["reason"] = "no rule matches"
+		response.Warnings = h.warnings(config.WarnSkip, vars)
+		response.AuditAnnotations = auditAnnotations(actionSkipped, vars)
 		return response
 	}
+	vars["rule"] = h.config.RuleName(rule)
+	vars["mode"] = h.config.ModeFor(rule)
+	if vars["mode"] == config.ModeShadow {
+		log = log.With("mode", config.ModeShadow)
+	}
 
-	slog.Info("VM matches rules, applying nested virtualization", "namespace", req.Namespace, "name", vm.Name)
+	log.Info("VM matches rules, applying nested virtualization", "namespace", req.Namespace, "name", vm.Name, "rule", vars["rule"])
 
 	// Create a copy of the VM for mutation
 	vmCopy := vm.DeepCopy()
 
 	// Mutate the VM
-	if err := h.mutator.MutateVM(vmCopy); err != nil {
-		response.Result = &metav1.Status{
-			Message: fmt.Sprintf("failed to mutate VirtualMachine: %v", err),
-		}
+	start = time.Now()
+	mutateCtx, span := tracing.Tracer().Start(ctx, tracing.SpanMutate)
+	result, err := h.mutator.Mutate(mutateCtx, vmCopy)
+	tracing.End(span, err)
+	metrics.ObserveStage(metrics.StageMutate, start)
+	if err != nil {
+		code, reason := failureStatus(err)
+		return h.failure(log, rule, vars, code, reason, fmt.Sprintf("failed to mutate VirtualMachine: %v", err))
+	}
+	vars["feature"] = string(result.Feature)
+	vars["policy"] = result.Policy
+
+	switch result.Action {
+	case mutation.ActionPresent:
+		log.Debug("No patch needed, VM already has nested virtualization enabled")
+		vars["reason"] = fmt.Sprintf("cpu feature %s already present", result.Feature)
+		response.Warnings = h.warnings(config.WarnSkip, vars)
+		response.AuditAnnotations = auditAnnotations(actionSkipped, vars)
+		return response
+	case mutation.ActionConflict:
+		log.Info("VM turns off the CPU feature itself, leaving it unchanged",
+			"namespace", req.Namespace,
+			"name", vm.Name,
+			"feature", result.Feature,
+			"policy", result.Policy)
+		vars["reason"] = fmt.Sprintf("cpu feature %s has policy %s", result.Feature, result.Policy)
+		response.Warnings = h.warnings(config.WarnConflict, vars)
+		response.AuditAnnotations = auditAnnotations(actionConflict, vars)
 		return response
 	}
 
-	// Create JSON patch
-	originalBytes, err := json.Marshal(vm)
+	h.setMarkers(vm, vmCopy, vars["rule"])
+
+	// Generate the JSON patch against the object as the API server sent it,
+	// since that is what the patch is applied to
+	start = time.Now()
+	_, span = tracing.Tracer().Start(ctx, tracing.SpanPatch)
+	patchBytes, err := createFeaturePatch(req.Object.Raw, vm, vmCopy)
 	if err != nil {
-		response.Result = &metav1.Status{
-			Message: fmt.Sprintf("failed to marshal original VM: %v", err),
-		}
-		return response
+		tracing.End(span, err)
+		metrics.ObserveStage(metrics.StagePatch, start)
+		return h.failure(log, rule, vars, http.StatusInternalServerError, metav1.StatusReasonInternalError,
+			fmt.Sprintf("failed to create JSON patch: %v", err))
 	}
 
-	mutatedBytes, err := json.Marshal(vmCopy)
+	err = verifyPatch(req.Object.Raw, patchBytes, vmCopy)
+	tracing.End(span, err)
+	metrics.ObserveStage(metrics.StagePatch, start)
 	if err != nil {
-		response.Result = &metav1.Status{
-			Message: fmt.Sprintf("failed to marshal mutated VM: %v", err),
-		}
-		return response
+		log.Error("Refusing patch that does not produce the mutated VM",
+			"namespace", req.Namespace,
+			"name", vm.Name,
+			"patch", string(patchBytes),
+			"error", err)
+		metrics.PatchVerificationFailures.Inc()
+		return h.failure(log, rule, vars, http.StatusInternalServerError, metav1.StatusReasonInternalError,
+			fmt.Sprintf("refusing patch that failed verification: %v", err))
 	}
 
-	// Generate JSON patch
-	patchBytes, err := createJSONPatch(originalBytes, mutatedBytes)
-	if err != nil {
-		response.Result = &metav1.Status{
-			Message: fmt.Sprintf("failed to create JSON patch: %v", err),
-		}
+	vars["reason"] = fmt.Sprintf("pattern %q matched", pattern)
+	response.Warnings = h.warnings(config.WarnMutation, vars)
+	response.AuditAnnotations = auditAnnotations(actionAdded, vars)
+	if vars["mode"] == config.ModeShadow {
+		log.Info("Shadow mode, not returning nested virtualization patch",
+			"namespace", req.Namespace,
+			"name", vm.Name,
+			"patch", string(patchBytes))
 		return response
 	}
 
-	if len(patchBytes) > 0 {
-		patchType := admissionv1.PatchTypeJSONPatch
-		response.Patch = patchBytes
-		response.PatchType = &patchType
-		slog.Info("Applied nested virtualization patch to VM",
+	patchType := admissionv1.PatchTypeJSONPatch
+	response.Patch = patchBytes
+	response.PatchType = &patchType
+	if dryRun {
+		log.Info("Returning nested virtualization patch for dry-run request",
 			"namespace", req.Namespace,
 			"name", vm.Name,
 			"patchSize", len(patchBytes))
 	} else {
-		slog.Debug("No patch needed, VM already has nested virtualization enabled")
+		log.Info("Applied nested virtualization patch to VM",
+			"namespace", req.Namespace,
+			"name", vm.Name,
+			"patchSize", len(patchBytes))
 	}
 
 	return response
 }
 
-// createJSONPatch creates a JSON patch between two JSON documents
-// This is a simplified implementation specific to our use case of patching
-// CPU features in VirtualMachine objects. For more complex scenarios,
-// consider using a dedicated library like github.com/evanphx/json-patch.
-func createJSONPatch(original, mutated []byte) ([]byte, error) {
-	// Simple implementation: unmarshal both, compare, and create patch
-	var origMap, mutMap map[string]interface{}
+// failure returns the response for a request the webhook could not handle,
+// following the on-error policy for rule, and logs it to log. rule is nil if
+// the failure happened before the VM was matched. code and reason are only
+// used when the request is denied. In shadow mode requests are never denied;
+// a deny is reported as a warning instead.
+func (h *WebhookHandler) failure(log *slog.Logger, rule *config.NamespaceRuleConfig, vars map[string]string, code int32, reason metav1.StatusReason, message string) *admissionv1.AdmissionResponse {
+	policy := h.config.OnErrorPolicy(rule)
+	log.Warn("Failed to handle VM", "namespace", vars["namespace"], "name", vars["name"], "error", message, "onError", policy)
+	if policy == config.OnErrorDeny && vars["mode"] == config.ModeShadow {
+		policy = config.OnErrorAllowWithWarning
+	}
 
-	if err := json.Unmarshal(original, &origMap); err != nil {
-		return nil, err
+	vars["reason"] = message
+	var response *admissionv1.AdmissionResponse
+	switch policy {
+	case config.OnErrorDeny:
+		response = &admissionv1.AdmissionResponse{
+			Allowed: false,
+			Result: &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Code:    code,
+				Reason:  reason,
+				Message: message,
+			},
+		}
+	case config.OnErrorAllowWithWarning:
+		vars["error"] = message
+		response = &admissionv1.AdmissionResponse{
+			Allowed:  true,
+			Result:   &metav1.Status{Message: message},
+			Warnings: h.warnings(config.WarnError, vars),
+		}
+	default:
+		response = &admissionv1.AdmissionResponse{
+			Allowed: true,
+			Result:  &metav1.Status{Message: message},
+		}
 	}
-	if err := json.Unmarshal(mutated, &mutMap); err != nil {
-		return nil, err
+	response.AuditAnnotations = auditAnnotations(actionError, vars)
+	return response
+}
+
+// shed answers a request that did not get one of the max-in-flight slots,
+// for the metrics.ShedReason reason, with the shed-policy decision
+func (h *WebhookHandler) shed(ctx context.Context, req *admissionv1.AdmissionRequest, reason string) (response *admissionv1.AdmissionResponse) {
+	metrics.Shed.WithLabelValues(reason).Inc()
+	dryRun := req.DryRun != nil && *req.DryRun
+	message := shedMessages[reason]
+	vars := map[string]string{"namespace": req.Namespace, "name": req.Name, "mode": h.config.ModeFor(nil), "reason": message}
+	defer func() { record(ctx, req, response, vars, dryRun) }()
+
+	policy := h.config.ShedDecision()
+	slog.Warn("Shedding admission request", "namespace", req.Namespace, "name", req.Name, "reason", message, "shedPolicy", policy, "dryRun", dryRun)
+	if policy == config.OnErrorDeny && vars["mode"] == config.ModeShadow {
+		policy = config.OnErrorAllowWithWarning
+	}
+	switch policy {
+	case config.OnErrorDeny:
+		response = &admissionv1.AdmissionResponse{
+			Allowed: false,
+			Result: &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Code:    http.StatusTooManyRequests,
+				Reason:  metav1.StatusReasonTooManyRequests,
+				Message: message,
+			},
+		}
+	case config.OnErrorAllowWithWarning:
+		response = &admissionv1.AdmissionResponse{
+			Allowed:  true,
+			Result:   &metav1.Status{Message: message},
+			Warnings: h.warnings(config.WarnShed, vars),
+		}
+	default:
+		response = &admissionv1.AdmissionResponse{
+			Allowed: true,
+			Result:  &metav1.Status{Message: message},
+		}
 	}
+	response.AuditAnnotations = auditAnnotations(actionShed, vars)
+	return response
+}
 
-	// Check if they're the same
-	origJSON, _ := json.Marshal(origMap)
-	mutJSON, _ := json.Marshal(mutMap)
+// failureStatus returns the status of a response denied because of err: a
+// timeout if the request ran out of time, an internal error otherwise
+func failureStatus(err error) (int32, metav1.StatusReason) {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return http.StatusGatewayTimeout, metav1.StatusReasonTimeout
+	}
+	return http.StatusInternalServerError, metav1.StatusReasonInternalError
+}
 
-	if string(origJSON) == string(mutJSON) {
-		return nil, nil
+// record counts the decision in response, which must carry audit
+// annotations, for req, and tags the request span in ctx with it. vars are
+// the placeholders filled in for it.
+func record(ctx context.Context, req *admissionv1.AdmissionRequest, response *admissionv1.AdmissionResponse, vars map[string]string, dryRun bool) {
+	action := response.AuditAnnotations["action"]
+	metrics.Requests.WithLabelValues(
+		string(req.Operation),
+		req.Namespace,
+		vars["rule"],
+		action,
+		vars["mode"],
+		strconv.FormatBool(dryRun),
+	).Inc()
+
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(
+		attribute.String(tracing.AttrVMName, vars["name"]),
+		attribute.String(tracing.AttrRule, vars["rule"]),
+		attribute.String(tracing.AttrMode, vars["mode"]),
+		attribute.String(tracing.AttrDecision, action),
+	)
+	if action == actionError {
+		span.SetStatus(codes.Error, vars["reason"])
 	}
+}
 
-	// For this use case, we need to patch the spec.template.spec.domain.cpu.features field
-	// Extract the CPU features from mutated
-	spec, ok := mutMap["spec"].(map[string]interface{})
-	if !ok {
-		return nil, nil
+// createJSONPatch returns the JSON Patch that turns original into mutated, or
+// nil if the documents are the same
+func createJSONPatch(original, mutated []byte) ([]byte, error) {
+	p, err := patch.Diff(original, mutated)
+	if err != nil || len(p) == 0 {
+		return nil, err
 	}
+	return json.Marshal(p)
+}
 
-	template, ok := spec["template"].(map[string]interface{})
-	if !ok {
-		return nil, nil
+// cpuFeaturesPath is the location of the CPU features in a VirtualMachine
+var cpuFeaturesPath = []string{"spec", "template", "spec", "domain", "cpu", "features"}
+
+// Locations of the maps in a VirtualMachine's metadata that markers are set in
+var (
+	annotationsPath = []string{"metadata", "annotations"}
+	labelsPath      = []string{"metadata", "labels"}
+)
+
+// createFeaturePatch returns a JSON Patch that appends the CPU features the
+// mutator added to the VM and sets the annotations and labels that were
+// added or changed, or nil if there are none. The patch only ever appends,
+// so features added by other mutating webhooks are kept, and a VM that
+// already has the feature gets no patch, which makes reinvocation safe.
+func createFeaturePatch(original []byte, vm, mutated *kubevirtv1.VirtualMachine) ([]byte, error) {
+	existing := map[string]bool{}
+	for _, name := range cpuFeatureNames(vm) {
+		existing[name] = true
 	}
 
-	templateSpec, ok := template["spec"].(map[string]interface{})
-	if !ok {
-		return nil, nil
+	var added []any
+	if mutated.Spec.Template != nil && mutated.Spec.Template.Spec.Domain.CPU != nil {
+		for _, f := range mutated.Spec.Template.Spec.Domain.CPU.Features {
+			if !existing[f.Name] {
+				added = append(added, f)
+			}
+		}
 	}
 
-	domain, ok := templateSpec["domain"].(map[string]interface{})
-	if !ok {
+	p, err := patch.Append(original, cpuFeaturesPath, added...)
+	if err != nil {
+		return nil, err
+	}
+	// Each patch is built against the document the previous ones produce, so
+	// that its guards hold when they are applied in order
+	doc, applied := original, 0
+	for _, maps := range []struct {
+		path          []string
+		before, after map[string]string
+	}{
+		{annotationsPath, vm.Annotations, mutated.Annotations},
+		{labelsPath, vm.Labels, mutated.Labels},
+	} {
+		members := changedMembers(maps.before, maps.after)
+		if len(members) == 0 {
+			continue
+		}
+		if doc, err = patch.Apply(doc, p[applied:]); err != nil {
+			return nil, err
+		}
+		applied = len(p)
+		set, err := patch.Set(doc, maps.path, members)
+		if err != nil {
+			return nil, err
+		}
+		p = append(p, set...)
+	}
+	if len(p) == 0 {
 		return nil, nil
 	}
+	return json.Marshal(p)
+}
 
-	cpu, ok := domain["cpu"].(map[string]interface{})
-	if !ok {
-		return nil, nil
+// changedMembers returns the members of after that are missing from before
+// or have a different value
+func changedMembers(before, after map[string]string) map[string]any {
+	members := map[string]any{}
+	for key, value := range after {
+		if old, ok := before[key]; !ok || old != value {
+			members[key] = value
+		}
 	}
+	return members
+}
 
-	features, ok := cpu["features"]
-	if !ok {
-		return nil, nil
+// verifyPatch applies patchBytes to the original object and checks that the
+// result decodes as a VirtualMachine equal to the mutated one, so that a bad
+// patch is caught here rather than by the API server
+func verifyPatch(original, patchBytes []byte, mutated *kubevirtv1.VirtualMachine) error {
+	p, err := patch.Decode(patchBytes)
+	if err != nil {
+		return err
+	}
+	patchedBytes, err := patch.Apply(original, p)
+	if err != nil {
+		return fmt.Errorf("failed to apply patch: %w", err)
 	}
 
-	// Create patch operations
-	patches := []map[string]interface{}{}
-
-	// Check if the path exists in original
-	origSpec, _ := origMap["spec"].(map[string]interface{})
-	origTemplate, _ := origSpec["template"].(map[string]interface{})
-	origTemplateSpec, _ := origTemplate["spec"].(map[string]interface{})
-	origDomain, _ := origTemplateSpec["domain"].(map[string]interface{})
-	origCPU, _ := origDomain["cpu"].(map[string]interface{})
-
-	if origCPU == nil {
-		// Need to add the entire CPU structure
-		patches = append(patches, map[string]interface{}{
-			"op":    "add",
-			"path":  "/spec/template/spec/domain/cpu",
-			"value": cpu,
-		})
-	} else if origCPU["features"] == nil {
-		// Need to add just the features
-		patches = append(patches, map[string]interface{}{
-			"op":    "add",
-			"path":  "/spec/template/spec/domain/cpu/features",
-			"value": features,
-		})
-	} else {
-		// Replace the features
-		patches = append(patches, map[string]interface{}{
-			"op":    "replace",
-			"path":  "/spec/template/spec/domain/cpu/features",
-			"value": features,
-		})
+	patched := &kubevirtv1.VirtualMachine{}
+	deserializer := codecs.UniversalDeserializer()
+	if _, _, err := deserializer.Decode(patchedBytes, nil, patched); err != nil {
+		return fmt.Errorf("patched object is not a valid VirtualMachine: %w", err)
+	}
+	if equality.Semantic.DeepEqual(patched, mutated) {
+		return nil
 	}
 
-	return json.Marshal(patches)
+	// Describe the difference as the patch that would fix it
+	const msg = "patched VirtualMachine differs from the mutated one"
+	mutatedBytes, mutatedErr := json.Marshal(mutated)
+	patchedBytes, patchedErr := json.Marshal(patched)
+	if mutatedErr == nil && patchedErr == nil {
+		if diff, err := createJSONPatch(patchedBytes, mutatedBytes); err == nil {
+			return fmt.Errorf("%s: missing %s", msg, diff)
+		}
+	}
+	return errors.New(msg)
 }
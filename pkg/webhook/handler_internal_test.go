@@ -2,32 +2,71 @@ package webhook
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	admissionv1 "k8s.io/api/admission/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	kubevirtv1 "kubevirt.io/api/core/v1"
 
 	"github.com/jaevans/harvester-enable-nested-virt/pkg/config"
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/metrics"
 	"github.com/jaevans/harvester-enable-nested-virt/pkg/mutation"
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/patch"
 )
 
 // MockCPUFeatureDetector for testing
 type MockCPUFeatureDetector struct {
 	feature mutation.CPUFeature
 	err     error
+	delay   time.Duration
 }
 
-func (m *MockCPUFeatureDetector) DetectFeature() (mutation.CPUFeature, error) {
+func (m *MockCPUFeatureDetector) DetectFeature(ctx context.Context) (mutation.CPUFeature, error) {
+	time.Sleep(m.delay)
 	return m.feature, m.err
 }
 
+// slowMatcher only answers once ctx is done, like a lookup that hangs
+type slowMatcher struct{}
+
+func (slowMatcher) MatchVM(ctx context.Context, namespace, name string) (*config.NamespaceRuleConfig, string, error) {
+	<-ctx.Done()
+	return nil, "", ctx.Err()
+}
+
+// vmRequest returns a CREATE request for a VM named name in test-namespace
+// that lists features, if any
+func vmRequest(name string, features ...kubevirtv1.CPUFeature) *admissionv1.AdmissionRequest {
+	vm := &kubevirtv1.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "test-namespace"},
+	}
+	if len(features) > 0 {
+		vm.Spec.Template = &kubevirtv1.VirtualMachineInstanceTemplateSpec{
+			Spec: kubevirtv1.VirtualMachineInstanceSpec{
+				Domain: kubevirtv1.DomainSpec{CPU: &kubevirtv1.CPU{Features: features}},
+			},
+		}
+	}
+	vmBytes, err := json.Marshal(vm)
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+	return &admissionv1.AdmissionRequest{
+		UID:       "test-uid",
+		Namespace: "test-namespace",
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: vmBytes},
+	}
+}
+
 var _ = Describe("Handler internal methods", func() {
 	var (
 		handler  *WebhookHandler
@@ -51,48 +90,119 @@ var _ = Describe("Handler internal methods", func() {
 		handler = NewWebhookHandler(cfg, mutator)
 	})
 
-	Describe("createJSONPatch", func() {
-		Context("when JSON parsing fails", func() {
-			DescribeTable("should return error for invalid JSON",
-				func(original, mutated []byte) {
-					patch, err := createJSONPatch(original, mutated)
-					Expect(err).To(HaveOccurred())
-					Expect(patch).To(BeNil())
-				},
-				Entry("invalid original JSON", []byte("{invalid"), []byte(`{}`)),
-				Entry("invalid mutated JSON", []byte(`{}`), []byte("{invalid")),
-				Entry("both invalid JSON", []byte("{invalid"), []byte("{invalid")),
-			)
+	Describe("createFeaturePatch", func() {
+		vmx := kubevirtv1.CPUFeature{Name: "vmx", Policy: "require"}
+
+		withFeatures := func(vm *kubevirtv1.VirtualMachine, features ...kubevirtv1.CPUFeature) *kubevirtv1.VirtualMachine {
+			mutated := vm.DeepCopy()
+			if mutated.Spec.Template == nil {
+				mutated.Spec.Template = &kubevirtv1.VirtualMachineInstanceTemplateSpec{}
+			}
+			if mutated.Spec.Template.Spec.Domain.CPU == nil {
+				mutated.Spec.Template.Spec.Domain.CPU = &kubevirtv1.CPU{}
+			}
+			mutated.Spec.Template.Spec.Domain.CPU.Features = append(mutated.Spec.Template.Spec.Domain.CPU.Features, features...)
+			return mutated
+		}
+
+		It("should return an error for invalid JSON", func() {
+			vm := &kubevirtv1.VirtualMachine{}
+			p, err := createFeaturePatch([]byte("{invalid"), vm, withFeatures(vm, vmx))
+			Expect(err).To(HaveOccurred())
+			Expect(p).To(BeNil())
+		})
+
+		It("should return nil when no features were added", func() {
+			vm := withFeatures(&kubevirtv1.VirtualMachine{}, vmx)
+			original, err := json.Marshal(vm)
+			Expect(err).NotTo(HaveOccurred())
+
+			p, err := createFeaturePatch(original, vm, vm.DeepCopy())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p).To(BeNil())
 		})
 
-		Context("when documents are identical", func() {
-			It("returns nil patch and no error", func() {
-				vm := map[string]interface{}{"spec": map[string]interface{}{}}
-				original, err := json.Marshal(vm)
+		DescribeTable("should produce a patch that adds only the new features",
+			func(raw string, vm *kubevirtv1.VirtualMachine, expectedOps []string) {
+				p, err := createFeaturePatch([]byte(raw), vm, withFeatures(vm, vmx))
 				Expect(err).NotTo(HaveOccurred())
 
-				patch, err := createJSONPatch(original, original)
+				ops, err := patch.Decode(p)
 				Expect(err).NotTo(HaveOccurred())
-				Expect(patch).To(BeNil())
-			})
+				opNames := []string{}
+				for _, op := range ops {
+					opNames = append(opNames, op.Op+" "+op.Path)
+				}
+				Expect(opNames).To(Equal(expectedOps))
+
+				result, err := patch.Apply([]byte(raw), ops)
+				Expect(err).NotTo(HaveOccurred())
+				patched := &kubevirtv1.VirtualMachine{}
+				Expect(json.Unmarshal(result, patched)).To(Succeed())
+				Expect(patched.Spec.Template.Spec.Domain.CPU.Features).To(Equal(
+					withFeatures(vm, vmx).Spec.Template.Spec.Domain.CPU.Features))
+			},
+			Entry("template is null",
+				`{"spec":{"template":null}}`,
+				&kubevirtv1.VirtualMachine{},
+				[]string{"test /spec/template", "replace /spec/template"}),
+			Entry("template is missing",
+				`{"spec":{}}`,
+				&kubevirtv1.VirtualMachine{},
+				[]string{"test /spec", "add /spec/template"}),
+			Entry("cpu is missing",
+				`{"spec":{"template":{"spec":{"domain":{"devices":{}}}}}}`,
+				&kubevirtv1.VirtualMachine{Spec: kubevirtv1.VirtualMachineSpec{
+					Template: &kubevirtv1.VirtualMachineInstanceTemplateSpec{},
+				}},
+				[]string{"test /spec/template/spec/domain", "add /spec/template/spec/domain/cpu"}),
+			Entry("features exist",
+				`{"spec":{"template":{"spec":{"domain":{"cpu":{"features":[{"name":"pcid"}]}}}}}}`,
+				withFeatures(&kubevirtv1.VirtualMachine{}, kubevirtv1.CPUFeature{Name: "pcid"}),
+				[]string{"add /spec/template/spec/domain/cpu/features/-"}),
+		)
+	})
+
+	Describe("verifyPatch", func() {
+		var (
+			original []byte
+			mutated  *kubevirtv1.VirtualMachine
+		)
+
+		BeforeEach(func() {
+			vm := &kubevirtv1.VirtualMachine{
+				ObjectMeta: metav1.ObjectMeta{Name: "vm-test-123", Namespace: "test-namespace"},
+			}
+			var err error
+			original, err = json.Marshal(vm)
+			Expect(err).NotTo(HaveOccurred())
+
+			mutated = vm.DeepCopy()
+			Expect(mutator.MutateVM(context.Background(), mutated)).To(Succeed())
 		})
 
-		Context("when VM structure is missing expected maps", func() {
-			DescribeTable("should return nil patch for malformed structures",
-				func(mutated []byte) {
-					patch, err := createJSONPatch([]byte(`{}`), mutated)
-					Expect(err).NotTo(HaveOccurred())
-					Expect(patch).To(BeNil())
-				},
-				Entry("spec is not a map", []byte(`{"spec":"invalid"}`)),
-				Entry("template is not a map", []byte(`{"spec":{"template":"invalid"}}`)),
-				Entry("template spec is not a map", []byte(`{"spec":{"template":{"spec":"invalid"}}}`)),
-				Entry("domain is not a map", []byte(`{"spec":{"template":{"spec":{"domain":"invalid"}}}}`)),
-				Entry("cpu is not a map", []byte(`{"spec":{"template":{"spec":{"domain":{"cpu":"invalid"}}}}}`)),
-				Entry("features are missing", []byte(`{"spec":{"template":{"spec":{"domain":{"cpu":{}}}}}}`)),
-			)
+		It("should accept a patch that produces the mutated VM", func() {
+			p, err := createFeaturePatch(original, &kubevirtv1.VirtualMachine{}, mutated)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(verifyPatch(original, p, mutated)).To(Succeed())
 		})
 
+		DescribeTable("should reject patches that do not produce the mutated VM",
+			func(p, message string) {
+				Expect(verifyPatch(original, []byte(p), mutated)).To(MatchError(ContainSubstring(message)))
+			},
+			Entry("malformed patch", `{"op":"add"}`, "failed to decode patch"),
+			Entry("patch that does not apply",
+				`[{"op":"test","path":"/spec/template","value":{}}]`, "failed to apply patch"),
+			Entry("patch that breaks the VM",
+				`[{"op":"replace","path":"/spec","value":"invalid"}]`, "not a valid VirtualMachine"),
+			Entry("patch that adds the wrong feature",
+				`[{"op":"replace","path":"/spec/template","value":{"spec":{"domain":{"cpu":{"features":[{"name":"svm"}]}}}}}]`,
+				`missing [{"op":"replace","path":"/spec/template/spec/domain/cpu/features/0/name","value":"vmx"}`),
+		)
+	})
+
+	Describe("Handle patches", func() {
 		Context("when VM has CPU but no features", func() {
 			It("should generate an add patch for features", func() {
 				vm := &kubevirtv1.VirtualMachine{
@@ -138,6 +248,7 @@ var _ = Describe("Handler internal methods", func() {
 				Expect(err).NotTo(HaveOccurred())
 
 				req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(reviewBytes))
+				req.Header.Set("Content-Type", "application/json")
 				w := httptest.NewRecorder()
 
 				handler.Handle(w, req)
@@ -151,18 +262,22 @@ var _ = Describe("Handler internal methods", func() {
 				Expect(responseReview.Response.Allowed).To(BeTrue())
 				Expect(responseReview.Response.Patch).NotTo(BeNil())
 
-				// Verify the patch is an add operation for features
+				// Verify the patch adds features to the unchanged cpu
 				var patches []map[string]interface{}
 				err = json.Unmarshal(responseReview.Response.Patch, &patches)
 				Expect(err).NotTo(HaveOccurred())
-				Expect(patches).NotTo(BeEmpty())
-				Expect(patches[0]["op"]).To(Equal("add"))
-				Expect(patches[0]["path"]).To(Equal("/spec/template/spec/domain/cpu/features"))
+				Expect(patches).To(HaveLen(4))
+				Expect(patches[0]["op"]).To(Equal("test"))
+				Expect(patches[0]["path"]).To(Equal("/spec/template/spec/domain/cpu"))
+				Expect(patches[1]["op"]).To(Equal("add"))
+				Expect(patches[1]["path"]).To(Equal("/spec/template/spec/domain/cpu/features"))
+				Expect(patches[3]["op"]).To(Equal("add"))
+				Expect(patches[3]["path"]).To(Equal("/metadata/annotations"))
 			})
 		})
 
 		Context("when VM has CPU with existing features", func() {
-			It("should generate a replace patch for features", func() {
+			It("should generate an add patch for the new feature only", func() {
 				vm := &kubevirtv1.VirtualMachine{
 					ObjectMeta: metav1.ObjectMeta{
 						Name:      "vm-test-123",
@@ -213,6 +328,7 @@ var _ = Describe("Handler internal methods", func() {
 				Expect(err).NotTo(HaveOccurred())
 
 				req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(reviewBytes))
+				req.Header.Set("Content-Type", "application/json")
 				w := httptest.NewRecorder()
 
 				handler.Handle(w, req)
@@ -226,13 +342,30 @@ var _ = Describe("Handler internal methods", func() {
 				Expect(responseReview.Response.Allowed).To(BeTrue())
 				Expect(responseReview.Response.Patch).NotTo(BeNil())
 
-				// Verify the patch is a replace operation for features
-				var patches []map[string]interface{}
-				err = json.Unmarshal(responseReview.Response.Patch, &patches)
-				Expect(err).NotTo(HaveOccurred())
-				Expect(patches).NotTo(BeEmpty())
-				Expect(patches[0]["op"]).To(Equal("replace"))
-				Expect(patches[0]["path"]).To(Equal("/spec/template/spec/domain/cpu/features"))
+				// Verify the patch appends vmx after the existing feature and
+				// records the change
+				Expect(responseReview.Response.Patch).To(MatchJSON(`[
+					{
+						"op": "add",
+						"path": "/spec/template/spec/domain/cpu/features/-",
+						"value": {"name": "vmx", "policy": "require"}
+					},
+					{
+						"op": "test",
+						"path": "/metadata",
+						"value": {"name": "vm-test-123", "namespace": "test-namespace", "creationTimestamp": null}
+					},
+					{
+						"op": "add",
+						"path": "/metadata/annotations",
+						"value": {
+							"nested-virt.jaevans.io/version": "dev",
+							"nested-virt.jaevans.io/rule": "rules[0]",
+							"nested-virt.jaevans.io/injected-features": "vmx",
+							"nested-virt.jaevans.io/original-features": "test-feature"
+						}
+					}
+				]`))
 			})
 		})
 	})
@@ -254,7 +387,7 @@ var _ = Describe("Handler internal methods", func() {
 					},
 				}
 
-				response := handler.mutate(req)
+				response := handler.mutate(context.Background(), req)
 
 				Expect(response).NotTo(BeNil())
 				Expect(response.Allowed).To(BeTrue())
@@ -264,6 +397,23 @@ var _ = Describe("Handler internal methods", func() {
 			})
 		})
 
+		Context("when the VM cannot be decoded and on-error is deny", func() {
+			It("should deny the request as a bad request", func() {
+				cfg.OnError = config.OnErrorDeny
+				response := handler.mutate(context.Background(), &admissionv1.AdmissionRequest{
+					UID:       "test-uid",
+					Namespace: "test-namespace",
+					Operation: admissionv1.Create,
+					Object:    runtime.RawExtension{Raw: []byte(`{"spec":"invalid"}`)},
+				})
+
+				Expect(response.Allowed).To(BeFalse())
+				Expect(response.Result.Code).To(Equal(int32(http.StatusBadRequest)))
+				Expect(response.Result.Reason).To(Equal(metav1.StatusReasonBadRequest))
+				Expect(response.Result.Message).To(ContainSubstring("failed to decode VirtualMachine"))
+			})
+		})
+
 		Context("when mutator fails", func() {
 			BeforeEach(func() {
 				// Replace mutator with one that will fail
@@ -299,7 +449,7 @@ var _ = Describe("Handler internal methods", func() {
 					},
 				}
 
-				response := handler.mutate(req)
+				response := handler.mutate(context.Background(), req)
 
 				Expect(response).NotTo(BeNil())
 				Expect(response.Allowed).To(BeTrue())
@@ -307,6 +457,452 @@ var _ = Describe("Handler internal methods", func() {
 				Expect(response.Result.Message).To(ContainSubstring("failed to mutate VirtualMachine"))
 				Expect(response.Patch).To(BeNil())
 			})
+
+			DescribeTable("should follow the on-error policy",
+				func(global, perRule string, allowed bool, warnings []string) {
+					cfg.OnError = global
+					cfg.Rules[0].OnError = perRule
+
+					vmBytes, err := json.Marshal(&kubevirtv1.VirtualMachine{
+						ObjectMeta: metav1.ObjectMeta{Name: "vm-test-123", Namespace: "test-namespace"},
+					})
+					Expect(err).NotTo(HaveOccurred())
+
+					response := handler.mutate(context.Background(), &admissionv1.AdmissionRequest{
+						UID:       "test-uid",
+						Namespace: "test-namespace",
+						Operation: admissionv1.Create,
+						Object:    runtime.RawExtension{Raw: vmBytes},
+					})
+
+					Expect(response.Allowed).To(Equal(allowed))
+					Expect(response.Warnings).To(Equal(warnings))
+					Expect(response.Patch).To(BeNil())
+					Expect(response.Result.Message).To(ContainSubstring("failed to mutate VirtualMachine"))
+					if !allowed {
+						Expect(response.Result.Status).To(Equal(metav1.StatusFailure))
+						Expect(response.Result.Code).To(Equal(int32(http.StatusInternalServerError)))
+						Expect(response.Result.Reason).To(Equal(metav1.StatusReasonInternalError))
+					}
+				},
+				Entry("default", "", "", true, nil),
+				Entry("global allow", config.OnErrorAllow, "", true, nil),
+				Entry("global allow-with-warning", config.OnErrorAllowWithWarning, "", true,
+					[]string{"nested-virt: failed to mutate VirtualMachine: failed to detect CPU feature: CPU detection failed"}),
+				Entry("global deny", config.OnErrorDeny, "", false, nil),
+				Entry("rule overrides global", config.OnErrorDeny, config.OnErrorAllow, true, nil),
+				Entry("rule denies", config.OnErrorAllow, config.OnErrorDeny, false, nil),
+			)
+		})
+
+		Context("when the request runs out of time", func() {
+			request := func() *admissionv1.AdmissionRequest {
+				vmBytes, err := json.Marshal(&kubevirtv1.VirtualMachine{
+					ObjectMeta: metav1.ObjectMeta{Name: "vm-test-123", Namespace: "test-namespace"},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				return &admissionv1.AdmissionRequest{
+					UID:       "test-uid",
+					Namespace: "test-namespace",
+					Operation: admissionv1.Create,
+					Object:    runtime.RawExtension{Raw: vmBytes},
+				}
+			}
+
+			It("should give up on a slow detector and deny with a timeout under on-error deny", func() {
+				cfg.OnError = config.OnErrorDeny
+				detector.delay = 2 * time.Second
+				ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+				defer cancel()
+
+				start := time.Now()
+				response := handler.mutate(ctx, request())
+				Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+				Expect(response.Allowed).To(BeFalse())
+				Expect(response.Result.Code).To(Equal(int32(http.StatusGatewayTimeout)))
+				Expect(response.Result.Reason).To(Equal(metav1.StatusReasonTimeout))
+				Expect(response.Result.Message).To(ContainSubstring(context.DeadlineExceeded.Error()))
+				Expect(response.AuditAnnotations).To(HaveKeyWithValue("action", actionError))
+			})
+
+			It("should give up on a slow matcher and follow on-error", func() {
+				handler.matcher = slowMatcher{}
+				ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+				defer cancel()
+
+				response := handler.mutate(ctx, request())
+				Expect(response.Allowed).To(BeTrue())
+				Expect(response.Patch).To(BeNil())
+				Expect(response.Result.Message).To(Equal("failed to match VirtualMachine against rules: context deadline exceeded"))
+			})
+
+			It("should derive the deadline from the timeout query parameter", func() {
+				Expect(admissionTimeout(httptest.NewRequest(http.MethodPost, "/mutate?timeout=5s", nil))).To(Equal(5 * time.Second))
+				Expect(admissionTimeout(httptest.NewRequest(http.MethodPost, "/mutate", nil))).To(Equal(defaultAdmissionTimeout))
+				Expect(admissionTimeout(httptest.NewRequest(http.MethodPost, "/mutate?timeout=soon", nil))).To(Equal(defaultAdmissionTimeout))
+			})
+		})
+
+		Context("when the patch verifies", func() {
+			It("should return it without counting a verification failure", func() {
+				vmBytes, err := json.Marshal(&kubevirtv1.VirtualMachine{
+					ObjectMeta: metav1.ObjectMeta{Name: "vm-test-123", Namespace: "test-namespace"},
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				failures := testutil.ToFloat64(metrics.PatchVerificationFailures)
+				response := handler.mutate(context.Background(), &admissionv1.AdmissionRequest{
+					UID:       "test-uid",
+					Namespace: "test-namespace",
+					Operation: admissionv1.Create,
+					Object:    runtime.RawExtension{Raw: vmBytes},
+				})
+				Expect(response.Result).To(BeNil())
+				Expect(response.Patch).NotTo(BeNil())
+				Expect(testutil.ToFloat64(metrics.PatchVerificationFailures)).To(Equal(failures))
+			})
+		})
+
+		Context("when returning warnings", func() {
+			BeforeEach(func() {
+				cfg.Rules[0].Name = "dev-all"
+			})
+
+			It("should tell the user which feature was added by which rule", func() {
+				response := handler.mutate(context.Background(), vmRequest("vm-test-123"))
+				Expect(response.Patch).NotTo(BeNil())
+				Expect(response.Warnings).To(Equal([]string{"nested-virt: added cpu feature vmx (rule dev-all)"}))
+			})
+
+			It("should warn when the VM turns the feature off itself", func() {
+				response := handler.mutate(context.Background(), vmRequest("vm-test-123", kubevirtv1.CPUFeature{Name: "vmx", Policy: "disable"}))
+				Expect(response.Patch).To(BeNil())
+				Expect(response.Warnings).To(Equal([]string{
+					"nested-virt: cpu feature vmx has policy disable and was not changed (rule dev-all)",
+				}))
+			})
+
+			It("should not warn about skipped VMs by default", func() {
+				Expect(handler.mutate(context.Background(), vmRequest("other-vm")).Warnings).To(BeNil())
+				Expect(handler.mutate(context.Background(), vmRequest("vm-test-123", kubevirtv1.CPUFeature{Name: "vmx"})).Warnings).To(BeNil())
+			})
+
+			It("should warn about skipped VMs when configured", func() {
+				skip := "{name} unchanged: {reason}"
+				cfg.Warnings = &config.WarningsConfig{Skip: &skip}
+
+				Expect(handler.mutate(context.Background(), vmRequest("other-vm")).Warnings).To(Equal([]string{
+					"nested-virt: other-vm unchanged: no rule matches",
+				}))
+				Expect(handler.mutate(context.Background(), vmRequest("vm-test-123", kubevirtv1.CPUFeature{Name: "vmx"})).Warnings).To(Equal([]string{
+					"nested-virt: vm-test-123 unchanged: cpu feature vmx already present",
+				}))
+			})
+
+			It("should not warn about mutations when turned off", func() {
+				off := ""
+				cfg.Warnings = &config.WarningsConfig{Mutation: &off}
+				response := handler.mutate(context.Background(), vmRequest("vm-test-123"))
+				Expect(response.Patch).NotTo(BeNil())
+				Expect(response.Warnings).To(BeNil())
+			})
+		})
+
+		Context("when the webhook is reinvoked", func() {
+			It("should not patch a VM it has already patched", func() {
+				vm := &kubevirtv1.VirtualMachine{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "vm-test-123",
+						Namespace: "test-namespace",
+					},
+				}
+				vmBytes, err := json.Marshal(vm)
+				Expect(err).NotTo(HaveOccurred())
+
+				req := &admissionv1.AdmissionRequest{
+					UID:       "test-uid",
+					Namespace: "test-namespace",
+					Operation: admissionv1.Create,
+					Object:    runtime.RawExtension{Raw: vmBytes},
+				}
+				response := handler.mutate(context.Background(), req)
+				Expect(response.Patch).NotTo(BeNil())
+
+				// Another webhook appends its own feature before we are reinvoked
+				ops, err := patch.Decode(response.Patch)
+				Expect(err).NotTo(HaveOccurred())
+				patched, err := patch.Apply(vmBytes, ops)
+				Expect(err).NotTo(HaveOccurred())
+				ops, err = patch.Decode([]byte(`[{"op":"add","path":"/spec/template/spec/domain/cpu/features/-","value":{"name":"pcid"}}]`))
+				Expect(err).NotTo(HaveOccurred())
+				patched, err = patch.Apply(patched, ops)
+				Expect(err).NotTo(HaveOccurred())
+
+				req.Object.Raw = patched
+				response = handler.mutate(context.Background(), req)
+				Expect(response.Result).To(BeNil())
+				Expect(response.Patch).To(BeNil())
+			})
+		})
+
+		Context("when the request is a dry run", func() {
+			var logs *bytes.Buffer
+
+			BeforeEach(func() {
+				logs = &bytes.Buffer{}
+				previous := slog.Default()
+				slog.SetDefault(slog.New(slog.NewTextHandler(logs, nil)))
+				DeferCleanup(slog.SetDefault, previous)
+			})
+
+			It("should return the same patch but label it as a dry run", func() {
+				vmBytes, err := json.Marshal(&kubevirtv1.VirtualMachine{
+					ObjectMeta: metav1.ObjectMeta{Name: "vm-test-123", Namespace: "test-namespace"},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				req := &admissionv1.AdmissionRequest{
+					UID:       "test-uid",
+					Namespace: "test-namespace",
+					Operation: admissionv1.Create,
+					Object:    runtime.RawExtension{Raw: vmBytes},
+				}
+				expected := handler.mutate(context.Background(), req)
+				Expect(logs.String()).To(ContainSubstring("Applied nested virtualization patch"))
+				Expect(logs.String()).NotTo(ContainSubstring("dryRun"))
+				logs.Reset()
+
+				dryRuns := testutil.ToFloat64(metrics.Requests.WithLabelValues("CREATE", "test-namespace", "rules[0]", "added", "enforce", "true"))
+				applied := testutil.ToFloat64(metrics.Requests.WithLabelValues("CREATE", "test-namespace", "rules[0]", "added", "enforce", "false"))
+				dryRun := true
+				req.DryRun = &dryRun
+				response := handler.mutate(context.Background(), req)
+
+				Expect(response.Patch).To(Equal(expected.Patch))
+				Expect(logs.String()).NotTo(ContainSubstring("Applied nested virtualization patch"))
+				Expect(logs.String()).To(ContainSubstring("patch for dry-run request"))
+				Expect(logs.String()).To(ContainSubstring("dryRun=true"))
+				Expect(testutil.ToFloat64(metrics.Requests.WithLabelValues("CREATE", "test-namespace", "rules[0]", "added", "enforce", "true"))).To(Equal(dryRuns + 1))
+				Expect(testutil.ToFloat64(metrics.Requests.WithLabelValues("CREATE", "test-namespace", "rules[0]", "added", "enforce", "false"))).To(Equal(applied))
+			})
+			It("should skip side effects", func() {
+				var ran []string
+				handler.sideEffects = []sideEffect{{
+					name: "record",
+					run: func(ctx context.Context, req *admissionv1.AdmissionRequest, response *admissionv1.AdmissionResponse) error {
+						ran = append(ran, response.AuditAnnotations["action"])
+						return nil
+					},
+				}}
+				req := vmRequest("vm-test-123")
+				handler.mutate(context.Background(), req)
+				Expect(ran).To(Equal([]string{"added"}))
+
+				dryRun := true
+				req.DryRun = &dryRun
+				response := handler.mutate(context.Background(), req)
+				Expect(response.Patch).NotTo(BeNil())
+				Expect(ran).To(HaveLen(1))
+			})
+
+			It("should keep the response when a side effect fails", func() {
+				handler.sideEffects = []sideEffect{{
+					name: "failing",
+					run: func(ctx context.Context, req *admissionv1.AdmissionRequest, response *admissionv1.AdmissionResponse) error {
+						return fmt.Errorf("unreachable")
+					},
+				}}
+				response := handler.mutate(context.Background(), vmRequest("vm-test-123"))
+				Expect(response.Patch).NotTo(BeNil())
+				Expect(logs.String()).To(ContainSubstring("sideEffect=failing"))
+			})
+		})
+
+		Context("when in shadow mode", func() {
+			var req *admissionv1.AdmissionRequest
+
+			BeforeEach(func() {
+				cfg.Rules[0].Name = "dev-all"
+				vmBytes, err := json.Marshal(&kubevirtv1.VirtualMachine{
+					ObjectMeta: metav1.ObjectMeta{Name: "vm-test-123", Namespace: "test-namespace"},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				req = &admissionv1.AdmissionRequest{
+					UID:       "test-uid",
+					Namespace: "test-namespace",
+					Operation: admissionv1.Create,
+					Object:    runtime.RawExtension{Raw: vmBytes},
+				}
+			})
+
+			DescribeTable("should report the patch without returning it",
+				func(global, perRule string) {
+					cfg.Mode = global
+					cfg.Rules[0].Mode = perRule
+
+					shadowed := testutil.ToFloat64(metrics.Requests.WithLabelValues("CREATE", "test-namespace", "dev-all", "added", "shadow", "false"))
+					response := handler.mutate(context.Background(), req)
+					Expect(response.Allowed).To(BeTrue())
+					Expect(response.Patch).To(BeNil())
+					Expect(response.PatchType).To(BeNil())
+					Expect(response.Warnings).To(Equal([]string{"nested-virt: [shadow] added cpu feature vmx (rule dev-all)"}))
+					Expect(response.AuditAnnotations).To(HaveKeyWithValue("action", "added"))
+					Expect(response.AuditAnnotations).To(HaveKeyWithValue("mode", "shadow"))
+					Expect(testutil.ToFloat64(metrics.Requests.WithLabelValues("CREATE", "test-namespace", "dev-all", "added", "shadow", "false"))).To(Equal(shadowed + 1))
+				},
+				Entry("global", config.ModeShadow, ""),
+				Entry("per rule", config.ModeEnforce, config.ModeShadow),
+			)
+
+			It("should return the patch when a rule enforces", func() {
+				cfg.Mode = config.ModeShadow
+				cfg.Rules[0].Mode = config.ModeEnforce
+				response := handler.mutate(context.Background(), req)
+				Expect(response.Patch).NotTo(BeNil())
+				Expect(response.AuditAnnotations).NotTo(HaveKey("mode"))
+			})
+
+			It("should not deny requests", func() {
+				cfg.Mode = config.ModeShadow
+				cfg.OnError = config.OnErrorDeny
+				detector.err = fmt.Errorf("CPU detection failed")
+
+				response := handler.mutate(context.Background(), req)
+				Expect(response.Allowed).To(BeTrue())
+				Expect(response.Warnings).To(Equal([]string{
+					"nested-virt: [shadow] failed to mutate VirtualMachine: failed to detect CPU feature: CPU detection failed",
+				}))
+			})
+		})
+
+		Context("when marking mutated VMs", func() {
+			mutate := func(vm *kubevirtv1.VirtualMachine) *kubevirtv1.VirtualMachine {
+				vmBytes, err := json.Marshal(vm)
+				Expect(err).NotTo(HaveOccurred())
+				response := handler.mutate(context.Background(), &admissionv1.AdmissionRequest{
+					UID:       "test-uid",
+					Namespace: "test-namespace",
+					Operation: admissionv1.Create,
+					Object:    runtime.RawExtension{Raw: vmBytes},
+				})
+				Expect(response.Result).To(BeNil())
+				Expect(response.Patch).NotTo(BeNil())
+
+				ops, err := patch.Decode(response.Patch)
+				Expect(err).NotTo(HaveOccurred())
+				patched, err := patch.Apply(vmBytes, ops)
+				Expect(err).NotTo(HaveOccurred())
+				result := &kubevirtv1.VirtualMachine{}
+				Expect(json.Unmarshal(patched, result)).To(Succeed())
+				return result
+			}
+
+			BeforeEach(func() {
+				cfg.Rules[0].Name = "dev-all"
+			})
+
+			It("should record what was changed and by whom", func() {
+				vm := mutate(&kubevirtv1.VirtualMachine{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:        "vm-test-123",
+						Namespace:   "test-namespace",
+						Annotations: map[string]string{"owner": "ci"},
+					},
+					Spec: kubevirtv1.VirtualMachineSpec{
+						Template: &kubevirtv1.VirtualMachineInstanceTemplateSpec{
+							Spec: kubevirtv1.VirtualMachineInstanceSpec{
+								Domain: kubevirtv1.DomainSpec{CPU: &kubevirtv1.CPU{Features: []kubevirtv1.CPUFeature{
+									{Name: "pcid"}, {Name: "ssse3"},
+								}}},
+							},
+						},
+					},
+				})
+				Expect(vm.Annotations).To(Equal(map[string]string{
+					"owner":                                    "ci",
+					"nested-virt.jaevans.io/version":           "dev",
+					"nested-virt.jaevans.io/rule":              "dev-all",
+					"nested-virt.jaevans.io/injected-features": "vmx",
+					"nested-virt.jaevans.io/original-features": "pcid,ssse3",
+				}))
+				Expect(vm.Labels).To(BeEmpty())
+			})
+
+			It("should add the configured label", func() {
+				cfg.Label = "nested-virt.jaevans.io/enabled=true"
+				vm := mutate(&kubevirtv1.VirtualMachine{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "vm-test-123",
+						Namespace: "test-namespace",
+						Labels:    map[string]string{"app": "builder"},
+					},
+				})
+				Expect(vm.Labels).To(Equal(map[string]string{
+					"app":                            "builder",
+					"nested-virt.jaevans.io/enabled": "true",
+				}))
+				Expect(vm.Annotations).To(HaveKeyWithValue("nested-virt.jaevans.io/original-features", ""))
+
+				// Without annotations or labels, both are added to the metadata
+				vm = mutate(&kubevirtv1.VirtualMachine{
+					ObjectMeta: metav1.ObjectMeta{Name: "vm-test-123", Namespace: "test-namespace"},
+				})
+				Expect(vm.Labels).To(Equal(map[string]string{"nested-virt.jaevans.io/enabled": "true"}))
+				Expect(vm.Annotations).To(HaveKeyWithValue("nested-virt.jaevans.io/injected-features", "vmx"))
+			})
+		})
+
+		Context("when recording audit annotations", func() {
+			BeforeEach(func() {
+				cfg.Rules[0].Name = "dev-all"
+			})
+
+			It("should record an added feature", func() {
+				Expect(handler.mutate(context.Background(), vmRequest("vm-test-123")).AuditAnnotations).To(Equal(map[string]string{
+					"action":  "added",
+					"rule":    "dev-all",
+					"feature": "vmx",
+					"reason":  `pattern "^vm-.*" matched`,
+				}))
+			})
+
+			It("should record a VM that no rule matches", func() {
+				Expect(handler.mutate(context.Background(), vmRequest("other-vm")).AuditAnnotations).To(Equal(map[string]string{
+					"action": "skipped",
+					"reason": "no rule matches",
+				}))
+			})
+
+			It("should record a feature that is already present", func() {
+				response := handler.mutate(context.Background(), vmRequest("vm-test-123", kubevirtv1.CPUFeature{Name: "vmx"}))
+				Expect(response.AuditAnnotations).To(Equal(map[string]string{
+					"action":  "skipped",
+					"rule":    "dev-all",
+					"feature": "vmx",
+					"reason":  "cpu feature vmx already present",
+				}))
+			})
+
+			It("should record a conflicting policy", func() {
+				response := handler.mutate(context.Background(), vmRequest("vm-test-123", kubevirtv1.CPUFeature{Name: "vmx", Policy: "forbid"}))
+				Expect(response.AuditAnnotations).To(Equal(map[string]string{
+					"action":  "conflict",
+					"rule":    "dev-all",
+					"feature": "vmx",
+					"reason":  "cpu feature vmx has policy forbid",
+				}))
+			})
+
+			It("should record errors whether or not the request is denied", func() {
+				detector.err = fmt.Errorf("CPU detection failed")
+				for _, policy := range []string{config.OnErrorAllow, config.OnErrorDeny} {
+					cfg.OnError = policy
+					Expect(handler.mutate(context.Background(), vmRequest("vm-test-123")).AuditAnnotations).To(Equal(map[string]string{
+						"action": "error",
+						"rule":   "dev-all",
+						"reason": "failed to mutate VirtualMachine: failed to detect CPU feature: CPU detection failed",
+					}))
+				}
+			})
 		})
 
 		Context("when VM does not match config rules", func() {
@@ -336,7 +932,7 @@ var _ = Describe("Handler internal methods", func() {
 					},
 				}
 
-				response := handler.mutate(req)
+				response := handler.mutate(context.Background(), req)
 
 				Expect(response).NotTo(BeNil())
 				Expect(response.Allowed).To(BeTrue())
@@ -2,6 +2,7 @@ package webhook_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -9,6 +10,9 @@ import (
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	admissionv1 "k8s.io/api/admission/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -16,6 +20,8 @@ import (
 
 	"github.com/jaevans/harvester-enable-nested-virt/pkg/config"
 	"github.com/jaevans/harvester-enable-nested-virt/pkg/mutation"
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/tracing"
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/tracing/tracingtest"
 	"github.com/jaevans/harvester-enable-nested-virt/pkg/webhook"
 )
 
@@ -25,7 +31,7 @@ type MockCPUFeatureDetector struct {
 	err     error
 }
 
-func (m *MockCPUFeatureDetector) DetectFeature() (mutation.CPUFeature, error) {
+func (m *MockCPUFeatureDetector) DetectFeature(ctx context.Context) (mutation.CPUFeature, error) {
 	return m.feature, m.err
 }
 
@@ -90,6 +96,7 @@ var _ = Describe("WebhookHandler", func() {
 				Expect(err).NotTo(HaveOccurred())
 
 				req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(reviewBytes))
+				req.Header.Set("Content-Type", "application/json")
 				w := httptest.NewRecorder()
 
 				handler.Handle(w, req)
@@ -140,6 +147,7 @@ var _ = Describe("WebhookHandler", func() {
 				Expect(err).NotTo(HaveOccurred())
 
 				req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(reviewBytes))
+				req.Header.Set("Content-Type", "application/json")
 				w := httptest.NewRecorder()
 
 				handler.Handle(w, req)
@@ -190,6 +198,7 @@ var _ = Describe("WebhookHandler", func() {
 				Expect(err).NotTo(HaveOccurred())
 
 				req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(reviewBytes))
+				req.Header.Set("Content-Type", "application/json")
 				w := httptest.NewRecorder()
 
 				handler.Handle(w, req)
@@ -217,6 +226,7 @@ var _ = Describe("WebhookHandler", func() {
 
 			It("should return error for invalid admission review", func() {
 				req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader([]byte("invalid json")))
+				req.Header.Set("Content-Type", "application/json")
 				w := httptest.NewRecorder()
 
 				handler.Handle(w, req)
@@ -237,6 +247,7 @@ var _ = Describe("WebhookHandler", func() {
 				Expect(err).NotTo(HaveOccurred())
 
 				req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(reviewBytes))
+				req.Header.Set("Content-Type", "application/json")
 				w := httptest.NewRecorder()
 
 				handler.Handle(w, req)
@@ -245,6 +256,166 @@ var _ = Describe("WebhookHandler", func() {
 			})
 		})
 
+		Context("when the request body is not an acceptable AdmissionReview", func() {
+			reviewError := func(w *httptest.ResponseRecorder) *metav1.Status {
+				Expect(w.Header().Get("Content-Type")).To(Equal("application/json"))
+				var responseReview admissionv1.AdmissionReview
+				Expect(json.Unmarshal(w.Body.Bytes(), &responseReview)).To(Succeed())
+				Expect(responseReview.APIVersion).To(Equal("admission.k8s.io/v1"))
+				Expect(responseReview.Response.Allowed).To(BeFalse())
+				return responseReview.Response.Result
+			}
+
+			DescribeTable("should reject content types other than JSON",
+				func(contentType string) {
+					req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader([]byte("{}")))
+					if contentType != "" {
+						req.Header.Set("Content-Type", contentType)
+					}
+					w := httptest.NewRecorder()
+
+					handler.Handle(w, req)
+
+					Expect(w.Code).To(Equal(http.StatusUnsupportedMediaType))
+					Expect(reviewError(w).Reason).To(Equal(metav1.StatusReasonUnsupportedMediaType))
+				},
+				Entry("none", ""),
+				Entry("YAML", "application/yaml"),
+				Entry("form", "application/x-www-form-urlencoded"),
+			)
+
+			It("should accept JSON with a charset", func() {
+				req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader([]byte(`{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview"}`)))
+				req.Header.Set("Content-Type", "application/json; charset=utf-8")
+				w := httptest.NewRecorder()
+
+				handler.Handle(w, req)
+
+				Expect(w.Code).To(Equal(http.StatusBadRequest))
+				Expect(reviewError(w).Message).To(Equal("admission review request is nil"))
+			})
+
+			It("should reject bodies larger than max-request-bytes", func() {
+				cfg.MaxRequestBytes = 64
+				req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(bytes.Repeat([]byte(" "), 65)))
+				req.Header.Set("Content-Type", "application/json")
+				w := httptest.NewRecorder()
+
+				handler.Handle(w, req)
+
+				Expect(w.Code).To(Equal(http.StatusRequestEntityTooLarge))
+				status := reviewError(w)
+				Expect(status.Reason).To(Equal(metav1.StatusReasonRequestEntityTooLarge))
+				Expect(status.Message).To(Equal("request body is larger than 64 bytes"))
+			})
+
+			It("should return the method that is allowed", func() {
+				req := httptest.NewRequest(http.MethodPut, "/mutate", nil)
+				w := httptest.NewRecorder()
+
+				handler.Handle(w, req)
+
+				Expect(w.Code).To(Equal(http.StatusMethodNotAllowed))
+				Expect(w.Header().Get("Allow")).To(Equal(http.MethodPost))
+				Expect(reviewError(w).Reason).To(Equal(metav1.StatusReasonMethodNotAllowed))
+			})
+		})
+
+		Context("when receiving different AdmissionReview versions", func() {
+			// review builds a request body for apiVersion by hand, so that
+			// each version is encoded exactly as the API server would send it
+			review := func(apiVersion, vmName string) []byte {
+				vmBytes, err := json.Marshal(&kubevirtv1.VirtualMachine{
+					ObjectMeta: metav1.ObjectMeta{Name: vmName, Namespace: "test-namespace"},
+				})
+				Expect(err).NotTo(HaveOccurred())
+				body := map[string]interface{}{
+					"kind": "AdmissionReview",
+					"request": map[string]interface{}{
+						"uid":       "test-uid",
+						"kind":      map[string]string{"group": "kubevirt.io", "version": "v1", "kind": "VirtualMachine"},
+						"resource":  map[string]string{"group": "kubevirt.io", "version": "v1", "resource": "virtualmachines"},
+						"namespace": "test-namespace",
+						"operation": "CREATE",
+						"userInfo":  map[string]string{"username": "admin"},
+						"object":    json.RawMessage(vmBytes),
+					},
+				}
+				if apiVersion != "" {
+					body["apiVersion"] = apiVersion
+				}
+				data, err := json.Marshal(body)
+				Expect(err).NotTo(HaveOccurred())
+				return data
+			}
+
+			DescribeTable("should respond in the version of the request",
+				func(requestVersion, vmName, responseVersion string, patched bool) {
+					req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(review(requestVersion, vmName)))
+					req.Header.Set("Content-Type", "application/json")
+					w := httptest.NewRecorder()
+
+					handler.Handle(w, req)
+					Expect(w.Code).To(Equal(http.StatusOK))
+
+					var response struct {
+						metav1.TypeMeta
+						Request  json.RawMessage `json:"request"`
+						Response struct {
+							UID       string `json:"uid"`
+							Allowed   bool   `json:"allowed"`
+							Patch     []byte `json:"patch"`
+							PatchType string `json:"patchType"`
+						} `json:"response"`
+					}
+					Expect(json.Unmarshal(w.Body.Bytes(), &response)).To(Succeed())
+					Expect(response.APIVersion).To(Equal(responseVersion))
+					Expect(response.Kind).To(Equal("AdmissionReview"))
+					Expect(response.Request).To(BeNil())
+					Expect(response.Response.UID).To(Equal("test-uid"))
+					Expect(response.Response.Allowed).To(BeTrue())
+					if patched {
+						Expect(response.Response.PatchType).To(Equal("JSONPatch"))
+						Expect(string(response.Response.Patch)).To(ContainSubstring(`"vmx"`))
+					} else {
+						Expect(response.Response.Patch).To(BeNil())
+						Expect(response.Response.PatchType).To(BeEmpty())
+					}
+				},
+				Entry("v1 matching VM", "admission.k8s.io/v1", "vm-test-123", "admission.k8s.io/v1", true),
+				Entry("v1 non-matching VM", "admission.k8s.io/v1", "other-vm", "admission.k8s.io/v1", false),
+				Entry("v1beta1 matching VM", "admission.k8s.io/v1beta1", "vm-test-123", "admission.k8s.io/v1beta1", true),
+				Entry("v1beta1 non-matching VM", "admission.k8s.io/v1beta1", "other-vm", "admission.k8s.io/v1beta1", false),
+				Entry("no apiVersion", "", "vm-test-123", "admission.k8s.io/v1", true),
+			)
+
+			DescribeTable("should reject reviews it cannot handle",
+				func(body string, message string) {
+					req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader([]byte(body)))
+					req.Header.Set("Content-Type", "application/json")
+					w := httptest.NewRecorder()
+
+					handler.Handle(w, req)
+					Expect(w.Code).To(Equal(http.StatusBadRequest))
+
+					var responseReview admissionv1.AdmissionReview
+					Expect(json.Unmarshal(w.Body.Bytes(), &responseReview)).To(Succeed())
+					Expect(responseReview.Response.Allowed).To(BeFalse())
+					Expect(responseReview.Response.Result.Code).To(Equal(int32(http.StatusBadRequest)))
+					Expect(responseReview.Response.Result.Message).To(ContainSubstring(message))
+				},
+				Entry("unsupported version",
+					`{"apiVersion":"admission.k8s.io/v2","kind":"AdmissionReview","request":{"uid":"test-uid"}}`,
+					`unsupported AdmissionReview version "admission.k8s.io/v2"`),
+				Entry("v1 without a request",
+					`{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview"}`,
+					"admission review request is nil"),
+				Entry("v1beta1 without a request",
+					`{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview"}`,
+					"admission review request is nil"),
+			)
+		})
+
 		Context("when CPU feature detection fails", func() {
 			BeforeEach(func() {
 				detector.err = fmt.Errorf("detection failed")
@@ -286,6 +457,7 @@ var _ = Describe("WebhookHandler", func() {
 				Expect(err).NotTo(HaveOccurred())
 
 				req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(reviewBytes))
+				req.Header.Set("Content-Type", "application/json")
 				w := httptest.NewRecorder()
 
 				handler.Handle(w, req)
@@ -301,11 +473,142 @@ var _ = Describe("WebhookHandler", func() {
 		})
 	})
 
+	Describe("tracing", func() {
+		var (
+			exporter *tracetest.InMemoryExporter
+			stop     func()
+		)
+
+		BeforeEach(func() {
+			exporter, stop = tracingtest.InMemory()
+		})
+
+		AfterEach(func() {
+			stop()
+		})
+
+		handle := func(traceparent string) {
+			vmBytes, err := json.Marshal(&kubevirtv1.VirtualMachine{
+				ObjectMeta: metav1.ObjectMeta{Name: "vm-test-123", Namespace: "test-namespace"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			reviewBytes, err := json.Marshal(&admissionv1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+				Request: &admissionv1.AdmissionRequest{
+					UID:       "test-uid",
+					Namespace: "test-namespace",
+					Operation: admissionv1.Create,
+					Object:    runtime.RawExtension{Raw: vmBytes},
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(reviewBytes))
+			req.Header.Set("Content-Type", "application/json")
+			if traceparent != "" {
+				req.Header.Set("traceparent", traceparent)
+			}
+			w := httptest.NewRecorder()
+			handler.Handle(w, req)
+			Expect(w.Code).To(Equal(http.StatusOK))
+		}
+
+		// spans returns the recorded spans by name
+		spans := func() map[string]tracetest.SpanStub {
+			byName := map[string]tracetest.SpanStub{}
+			for _, span := range exporter.GetSpans() {
+				byName[span.Name] = span
+			}
+			return byName
+		}
+
+		It("should trace each stage of a request in a span of its own", func() {
+			handle("")
+
+			recorded := spans()
+			Expect(recorded).To(HaveLen(6))
+			root := recorded[tracing.SpanRequest]
+			Expect(root.Parent.IsValid()).To(BeFalse())
+			Expect(root.Attributes).To(ContainElements(
+				attribute.String(tracing.AttrUID, "test-uid"),
+				attribute.String(tracing.AttrNamespace, "test-namespace"),
+				attribute.String(tracing.AttrVMName, "vm-test-123"),
+				attribute.String(tracing.AttrDecision, "added"),
+			))
+			for _, stage := range []string{tracing.SpanDecode, tracing.SpanMatch, tracing.SpanMutate, tracing.SpanPatch} {
+				Expect(recorded).To(HaveKey(stage))
+				Expect(recorded[stage].Parent.SpanID()).To(Equal(root.SpanContext.SpanID()), stage)
+			}
+			Expect(recorded[tracing.SpanDetect].Parent.SpanID()).To(Equal(recorded[tracing.SpanMutate].SpanContext.SpanID()))
+		})
+
+		It("should continue the API server's trace", func() {
+			handle("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+			root := spans()[tracing.SpanRequest]
+			Expect(root.SpanContext.TraceID().String()).To(Equal("4bf92f3577b34da6a3ce929d0e0e4736"))
+			Expect(root.Parent.SpanID().String()).To(Equal("00f067aa0ba902b7"))
+		})
+
+		It("should mark the spans of a failed request", func() {
+			detector.err = fmt.Errorf("detection failed")
+			handle("")
+
+			recorded := spans()
+			Expect(recorded[tracing.SpanDetect].Status.Code).To(Equal(codes.Error))
+			Expect(recorded[tracing.SpanMutate].Status.Code).To(Equal(codes.Error))
+			Expect(recorded[tracing.SpanPatch].Name).To(BeEmpty())
+			root := recorded[tracing.SpanRequest]
+			Expect(root.Status.Code).To(Equal(codes.Error))
+			Expect(root.Attributes).To(ContainElement(attribute.String(tracing.AttrDecision, "error")))
+		})
+
+		It("should mark the request span of a rejected review", func() {
+			req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader([]byte("{}")))
+			req.Header.Set("Content-Type", "text/plain")
+			w := httptest.NewRecorder()
+			handler.Handle(w, req)
+			Expect(w.Code).To(Equal(http.StatusUnsupportedMediaType))
+
+			recorded := spans()
+			Expect(recorded).To(HaveLen(1))
+			Expect(recorded[tracing.SpanRequest].Status.Code).To(Equal(codes.Error))
+		})
+	})
+
 	Describe("NewWebhookHandler", func() {
 		It("should create a new webhook handler", func() {
 			handler := webhook.NewWebhookHandler(cfg, mutator)
 			Expect(handler).NotTo(BeNil())
 		})
+
+		It("should admit VMs unchanged without a config", func() {
+			vmBytes, err := json.Marshal(&kubevirtv1.VirtualMachine{
+				ObjectMeta: metav1.ObjectMeta{Name: "vm-test-123", Namespace: "test-namespace"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			reviewBytes, err := json.Marshal(&admissionv1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+				Request: &admissionv1.AdmissionRequest{
+					UID:       "test-uid",
+					Namespace: "test-namespace",
+					Operation: admissionv1.Create,
+					Object:    runtime.RawExtension{Raw: vmBytes},
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(reviewBytes))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			webhook.NewWebhookHandler(nil, mutator).Handle(w, req)
+
+			Expect(w.Code).To(Equal(http.StatusOK))
+			var responseReview admissionv1.AdmissionReview
+			Expect(json.Unmarshal(w.Body.Bytes(), &responseReview)).To(Succeed())
+			Expect(responseReview.Response.Allowed).To(BeTrue())
+			Expect(responseReview.Response.Patch).To(BeNil())
+		})
 	})
 
 })
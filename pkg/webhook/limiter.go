@@ -0,0 +1,88 @@
+package webhook
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/metrics"
+)
+
+// limiter bounds the number of admission requests handled at once. Requests
+// over the limit wait in a queue of bounded length for a bounded time, and
+// are shed if they cannot get a slot.
+type limiter struct {
+	// slots holds a token for each request in flight; nil means no limit
+	slots chan struct{}
+	// maxQueue is how many requests may wait for a slot
+	maxQueue int64
+	queued   atomic.Int64
+	// maxWait is the longest a request waits for a slot
+	maxWait time.Duration
+}
+
+func newLimiter(maxInFlight, maxQueue int, maxWait time.Duration) *limiter {
+	l := &limiter{maxQueue: int64(maxQueue), maxWait: maxWait}
+	if maxInFlight > 0 {
+		l.slots = make(chan struct{}, maxInFlight)
+	}
+	return l
+}
+
+// shedMessages explain each metrics.ShedReason in warnings and responses
+var shedMessages = map[string]string{
+	metrics.ShedQueueFull: "the webhook is overloaded",
+	metrics.ShedTimeout:   "timed out waiting for the webhook",
+}
+
+// acquire waits for a slot for a request the API server gave timeout to
+// respond to. On success it returns a function that releases the slot;
+// otherwise it returns the metrics.ShedReason the request is shed for.
+func (l *limiter) acquire(ctx context.Context, timeout time.Duration) (release func(), reason string) {
+	if l.slots == nil {
+		return l.admit(), ""
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return l.admit(), ""
+	default:
+	}
+
+	if l.queued.Add(1) > l.maxQueue {
+		l.queued.Add(-1)
+		return nil, metrics.ShedQueueFull
+	}
+	metrics.QueueDepth.Inc()
+	defer func() {
+		l.queued.Add(-1)
+		metrics.QueueDepth.Dec()
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, l.wait(timeout))
+	defer cancel()
+	select {
+	case l.slots <- struct{}{}:
+		return l.admit(), ""
+	case <-ctx.Done():
+		return nil, metrics.ShedTimeout
+	}
+}
+
+// wait returns how long a request may wait for a slot: maxWait, but no
+// more than half of the API server's timeout, so that a shed decision still
+// reaches the API server in time
+func (l *limiter) wait(timeout time.Duration) time.Duration {
+	return min(l.maxWait, timeout/2)
+}
+
+// admit counts a request that got a slot as in flight, and returns the
+// function that releases the slot
+func (l *limiter) admit() func() {
+	metrics.InFlight.Inc()
+	return func() {
+		metrics.InFlight.Dec()
+		if l.slots != nil {
+			<-l.slots
+		}
+	}
+}
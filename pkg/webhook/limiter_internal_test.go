@@ -0,0 +1,162 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/config"
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/metrics"
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/mutation"
+)
+
+var _ = Describe("limiter", func() {
+	ctx := context.Background()
+
+	It("should not limit requests without max-in-flight", func() {
+		l := newLimiter(0, 0, time.Second)
+		for i := 0; i < 10; i++ {
+			release, reason := l.acquire(ctx, defaultAdmissionTimeout)
+			Expect(release).NotTo(BeNil())
+			Expect(reason).To(BeEmpty())
+			defer release()
+		}
+		Expect(testutil.ToFloat64(metrics.InFlight)).To(BeNumerically(">=", 10))
+	})
+
+	It("should shed at once when the queue is full", func() {
+		l := newLimiter(1, 0, time.Minute)
+		release, _ := l.acquire(ctx, defaultAdmissionTimeout)
+		defer release()
+
+		start := time.Now()
+		_, reason := l.acquire(ctx, defaultAdmissionTimeout)
+		Expect(reason).To(Equal(metrics.ShedQueueFull))
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+	})
+
+	It("should give a queued request the next free slot", func() {
+		l := newLimiter(1, 1, time.Minute)
+		release, _ := l.acquire(ctx, defaultAdmissionTimeout)
+
+		acquired := make(chan func(), 1)
+		go func() {
+			next, _ := l.acquire(ctx, defaultAdmissionTimeout)
+			acquired <- next
+		}()
+		Eventually(func() float64 { return testutil.ToFloat64(metrics.QueueDepth) }).Should(Equal(1.0))
+		Consistently(acquired, 100*time.Millisecond).ShouldNot(Receive())
+
+		release()
+		var next func()
+		Eventually(acquired).Should(Receive(&next))
+		Expect(next).NotTo(BeNil())
+		next()
+		Expect(testutil.ToFloat64(metrics.QueueDepth)).To(Equal(0.0))
+	})
+
+	It("should wait no more than half the API server's timeout", func() {
+		l := newLimiter(1, 1, time.Minute)
+		release, _ := l.acquire(ctx, defaultAdmissionTimeout)
+		defer release()
+
+		Expect(l.wait(10 * time.Second)).To(Equal(5 * time.Second))
+		Expect(l.wait(10 * time.Minute)).To(Equal(time.Minute))
+
+		start := time.Now()
+		_, reason := l.acquire(ctx, 400*time.Millisecond)
+		Expect(reason).To(Equal(metrics.ShedTimeout))
+		Expect(time.Since(start)).To(And(
+			BeNumerically(">=", 200*time.Millisecond),
+			BeNumerically("<", time.Second),
+		))
+	})
+
+	It("should not wait for a slot when max-queue-wait is zero", func() {
+		l := newLimiter(1, 1, 0)
+		release, _ := l.acquire(ctx, defaultAdmissionTimeout)
+		defer release()
+
+		start := time.Now()
+		_, reason := l.acquire(ctx, defaultAdmissionTimeout)
+		Expect(reason).To(Equal(metrics.ShedTimeout))
+		Expect(time.Since(start)).To(BeNumerically("<", 100*time.Millisecond))
+	})
+
+	Describe("shedding in Handle", func() {
+		var (
+			cfg     *config.Config
+			handler *WebhookHandler
+		)
+
+		handle := func() *admissionv1.AdmissionResponse {
+			body, err := json.Marshal(&admissionv1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+				Request: &admissionv1.AdmissionRequest{
+					UID:       "shed-uid",
+					Name:      "vm-1",
+					Namespace: "test-namespace",
+					Operation: admissionv1.Create,
+					Object:    runtime.RawExtension{Raw: []byte(`{"metadata":{"name":"vm-1"}}`)},
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			req := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			handler.Handle(w, req)
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			var review admissionv1.AdmissionReview
+			Expect(json.Unmarshal(w.Body.Bytes(), &review)).To(Succeed())
+			Expect(review.Response.UID).To(BeEquivalentTo("shed-uid"))
+			return review.Response
+		}
+
+		BeforeEach(func() {
+			cfg = &config.Config{MaxInFlight: 1}
+			handler = NewWebhookHandler(cfg, mutation.NewVMFeatureMutator(&MockCPUFeatureDetector{feature: mutation.CPUFeatureVMX}))
+			// Take the only slot, as if a request were in flight
+			release, _ := handler.limiter.acquire(ctx, defaultAdmissionTimeout)
+			DeferCleanup(release)
+		})
+
+		It("should admit the VM with a warning by default", func() {
+			shed := testutil.ToFloat64(metrics.Shed.WithLabelValues(metrics.ShedQueueFull))
+
+			response := handle()
+			Expect(response.Allowed).To(BeTrue())
+			Expect(response.Patch).To(BeNil())
+			Expect(response.Warnings).To(Equal([]string{"nested-virt: admitted without nested virtualization: the webhook is overloaded"}))
+			Expect(response.AuditAnnotations).To(HaveKeyWithValue("action", actionShed))
+			Expect(testutil.ToFloat64(metrics.Shed.WithLabelValues(metrics.ShedQueueFull))).To(Equal(shed + 1))
+		})
+
+		It("should deny the VM with shed-policy deny", func() {
+			cfg.ShedPolicy = config.OnErrorDeny
+
+			response := handle()
+			Expect(response.Allowed).To(BeFalse())
+			Expect(response.Result.Code).To(Equal(int32(http.StatusTooManyRequests)))
+			Expect(response.Result.Reason).To(Equal(metav1.StatusReasonTooManyRequests))
+		})
+
+		It("should admit the VM without a warning with shed-policy allow", func() {
+			cfg.ShedPolicy = config.OnErrorAllow
+
+			response := handle()
+			Expect(response.Allowed).To(BeTrue())
+			Expect(response.Warnings).To(BeEmpty())
+		})
+	})
+})
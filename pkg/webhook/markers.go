@@ -0,0 +1,70 @@
+package webhook
+
+import (
+	"strings"
+
+	kubevirtv1 "kubevirt.io/api/core/v1"
+)
+
+// Version is the version of the webhook recorded on the VMs it mutates. It is
+// set by main from the build.
+var Version = "dev"
+
+// Annotations added to every VM the webhook mutates, so that it can be told
+// apart from a hand-configured one and the change can be undone
+const (
+	markerPrefix = "nested-virt.jaevans.io/"
+	// AnnotationVersion is the version of the webhook that mutated the VM
+	AnnotationVersion = markerPrefix + "version"
+	// AnnotationRule is the name of the rule that selected the VM
+	AnnotationRule = markerPrefix + "rule"
+	// AnnotationInjectedFeatures lists the CPU features the webhook added,
+	// separated by commas
+	AnnotationInjectedFeatures = markerPrefix + "injected-features"
+	// AnnotationOriginalFeatures lists the CPU features the VM had before,
+	// separated by commas; it is empty if the VM had none
+	AnnotationOriginalFeatures = markerPrefix + "original-features"
+)
+
+// setMarkers records on mutated how it differs from vm: the marker
+// annotations, and the configured label if there is one
+func (h *WebhookHandler) setMarkers(vm, mutated *kubevirtv1.VirtualMachine, rule string) {
+	original := cpuFeatureNames(vm)
+	existing := map[string]bool{}
+	for _, name := range original {
+		existing[name] = true
+	}
+	var injected []string
+	for _, name := range cpuFeatureNames(mutated) {
+		if !existing[name] {
+			injected = append(injected, name)
+		}
+	}
+
+	if mutated.Annotations == nil {
+		mutated.Annotations = map[string]string{}
+	}
+	mutated.Annotations[AnnotationVersion] = Version
+	mutated.Annotations[AnnotationRule] = rule
+	mutated.Annotations[AnnotationInjectedFeatures] = strings.Join(injected, ",")
+	mutated.Annotations[AnnotationOriginalFeatures] = strings.Join(original, ",")
+
+	if key, value, ok := h.config.MarkerLabel(); ok {
+		if mutated.Labels == nil {
+			mutated.Labels = map[string]string{}
+		}
+		mutated.Labels[key] = value
+	}
+}
+
+// cpuFeatureNames returns the names of the CPU features of vm in order
+func cpuFeatureNames(vm *kubevirtv1.VirtualMachine) []string {
+	if vm.Spec.Template == nil || vm.Spec.Template.Spec.Domain.CPU == nil {
+		return nil
+	}
+	names := make([]string, 0, len(vm.Spec.Template.Spec.Domain.CPU.Features))
+	for _, f := range vm.Spec.Template.Spec.Domain.CPU.Features {
+		names = append(names, f.Name)
+	}
+	return names
+}
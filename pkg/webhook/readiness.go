@@ -0,0 +1,142 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// readinessCheck is one of the named checks behind /readyz. check returns
+// nil if the server is ready as far as it is concerned.
+type readinessCheck struct {
+	name  string
+	check func() error
+}
+
+// readinessResult is the outcome of a readinessCheck in the verbose /readyz
+// response
+type readinessResult struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// readinessReport is the verbose /readyz response
+type readinessReport struct {
+	Status string            `json:"status"`
+	Checks []readinessResult `json:"checks"`
+}
+
+// detectorCheckTimeout bounds how long the detector check waits for the CPU
+// feature, well within the kubelet's default probe timeout
+const detectorCheckTimeout = 500 * time.Millisecond
+
+// Statuses of a readinessResult and readinessReport
+const (
+	readinessOK     = "ok"
+	readinessFailed = "failed"
+)
+
+// readinessChecks returns the checks that must pass for the server to be
+// ready, in the order they are reported
+func (s *Server) readinessChecks() []readinessCheck {
+	return []readinessCheck{
+		{"config", s.checkConfig},
+		{"detector", s.checkDetector},
+		{"certificate", s.checkCertificate},
+		{"draining", s.checkDraining},
+	}
+}
+
+func (s *Server) checkConfig() error {
+	if s.handler.config == nil {
+		return errors.New("no configuration loaded")
+	}
+	return nil
+}
+
+func (s *Server) checkDetector() error {
+	if s.handler.mutator == nil {
+		return errors.New("no mutator configured")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), detectorCheckTimeout)
+	defer cancel()
+	_, err := s.handler.mutator.DetectFeature(ctx)
+	return err
+}
+
+// checkCertificate fails if there is no certificate, or it expires within
+// certExpiryThreshold. A failed reload does not fail the check as long as
+// the certificate in use is still good.
+func (s *Server) checkCertificate() error {
+	status := s.certs.Status()
+	switch {
+	case status.NotAfter.IsZero():
+		return fmt.Errorf("not loaded: %v", status.Err)
+	case time.Now().After(status.NotAfter):
+		return fmt.Errorf("expired at %s", status.NotAfter.Format(time.RFC3339))
+	case time.Until(status.NotAfter) < s.certExpiryThreshold:
+		return fmt.Errorf("expires at %s, within %s", status.NotAfter.Format(time.RFC3339), s.certExpiryThreshold)
+	}
+	return nil
+}
+
+func (s *Server) checkDraining() error {
+	if s.draining.Load() {
+		return errors.New("server is shutting down")
+	}
+	return nil
+}
+
+// readyzHandler runs every readiness check and reports 200 if they all pass
+// or 503 otherwise. With ?verbose the outcome of each check is returned as
+// JSON; otherwise the body is "ok", or the failed checks in the style of the
+// kube-apiserver.
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	report := readinessReport{Status: readinessOK}
+	for _, c := range s.readinessChecks() {
+		result := readinessResult{Name: c.name, Status: readinessOK}
+		if err := c.check(); err != nil {
+			result.Status = readinessFailed
+			result.Message = err.Error()
+			report.Status = readinessFailed
+		}
+		report.Checks = append(report.Checks, result)
+	}
+
+	code := http.StatusOK
+	if report.Status != readinessOK {
+		code = http.StatusServiceUnavailable
+	}
+
+	if _, verbose := r.URL.Query()["verbose"]; verbose {
+		body, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to encode readiness: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		w.Write(body) //nolint:errcheck
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	if code == http.StatusOK {
+		w.Write([]byte(readinessOK)) //nolint:errcheck
+		return
+	}
+	var b strings.Builder
+	for _, result := range report.Checks {
+		if result.Status != readinessOK {
+			fmt.Fprintf(&b, "[-]%s failed: %s\n", result.Name, result.Message)
+		}
+	}
+	b.WriteString("readyz check failed\n")
+	w.Write([]byte(b.String())) //nolint:errcheck
+}
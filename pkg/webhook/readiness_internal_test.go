@@ -0,0 +1,103 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/config"
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/mutation"
+)
+
+var _ = Describe("readyzHandler", func() {
+	var (
+		server   *Server
+		detector *MockCPUFeatureDetector
+	)
+
+	loadCert := func(cert, key []byte) {
+		Expect(os.WriteFile(server.certs.certFile, cert, 0600)).To(Succeed())
+		Expect(os.WriteFile(server.certs.keyFile, key, 0600)).To(Succeed())
+		_, err := server.certs.Load()
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	readyz := func(query string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		server.readyzHandler(rr, httptest.NewRequest(http.MethodGet, "/readyz"+query, nil))
+		return rr
+	}
+
+	BeforeEach(func() {
+		dir := GinkgoT().TempDir()
+		detector = &MockCPUFeatureDetector{feature: mutation.CPUFeatureVMX}
+		handler := NewWebhookHandler(&config.Config{}, mutation.NewVMFeatureMutator(detector))
+		server = NewServer(ServerConfig{
+			CertFile:            filepath.Join(dir, "tls.crt"),
+			KeyFile:             filepath.Join(dir, "tls.key"),
+			CertExpiryThreshold: time.Hour,
+		}, handler)
+		loadCert(testCert, testKey)
+	})
+
+	It("should be ready when every check passes", func() {
+		rr := readyz("")
+		Expect(rr.Code).To(Equal(http.StatusOK))
+		Expect(rr.Body.String()).To(Equal("ok"))
+	})
+
+	DescribeTable("should not be ready when a check fails",
+		func(fail func(), name, message string) {
+			fail()
+			rr := readyz("")
+			Expect(rr.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(rr.Body.String()).To(Equal(fmt.Sprintf("[-]%s failed: %s\nreadyz check failed\n", name, message)))
+		},
+		Entry("config", func() { server.handler.config = nil }, "config", "no configuration loaded"),
+		Entry("detector", func() { detector.err = fmt.Errorf("no vmx or svm") }, "detector", "no vmx or svm"),
+		Entry("draining", func() { server.draining.Store(true) }, "draining", "server is shutting down"),
+	)
+
+	DescribeTable("should check the certificate",
+		func(notAfter time.Duration, message string) {
+			loadCert(generateTestCertificatesValidUntil(time.Now().Add(notAfter)))
+			rr := readyz("")
+			Expect(rr.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(rr.Body.String()).To(MatchRegexp(`^\[-\]certificate failed: ` + message))
+		},
+		Entry("expired", -time.Minute, "expired at "),
+		Entry("near expiry", 30*time.Minute, `expires at .*, within 1h0m0s`),
+	)
+
+	It("should not be ready without a certificate", func() {
+		server.certs = newCertLoader(server.certs.certFile+".missing", server.certs.keyFile)
+		_, _ = server.certs.Load()
+		Expect(readyz("").Body.String()).To(ContainSubstring("[-]certificate failed: not loaded: "))
+	})
+
+	It("should report every check as JSON when verbose", func() {
+		detector.err = fmt.Errorf("no vmx or svm")
+		rr := readyz("?verbose")
+		Expect(rr.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(rr.Header().Get("Content-Type")).To(Equal("application/json"))
+
+		var report readinessReport
+		Expect(json.Unmarshal(rr.Body.Bytes(), &report)).To(Succeed())
+		Expect(report).To(Equal(readinessReport{
+			Status: "failed",
+			Checks: []readinessResult{
+				{Name: "config", Status: "ok"},
+				{Name: "detector", Status: "failed", Message: "no vmx or svm"},
+				{Name: "certificate", Status: "ok"},
+				{Name: "draining", Status: "ok"},
+			},
+		}))
+	})
+})
@@ -0,0 +1,116 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// admissionReview is a decoded AdmissionReview of any supported version. The
+// request is converted to admission.k8s.io/v1 so the rest of the handler only
+// deals with one version; the response is converted back when encoded.
+type admissionReview struct {
+	typeMeta metav1.TypeMeta
+	request  *admissionv1.AdmissionRequest
+}
+
+// decodeAdmissionReview decodes an admission.k8s.io/v1 or v1beta1
+// AdmissionReview. A review without an apiVersion is treated as v1.
+func decodeAdmissionReview(body []byte) (*admissionReview, error) {
+	var typeMeta metav1.TypeMeta
+	if err := json.Unmarshal(body, &typeMeta); err != nil {
+		return nil, err
+	}
+
+	deserializer := codecs.UniversalDeserializer()
+	switch typeMeta.APIVersion {
+	case admissionv1.SchemeGroupVersion.String(), "":
+		review := &admissionv1.AdmissionReview{}
+		if _, _, err := deserializer.Decode(body, nil, review); err != nil {
+			return nil, err
+		}
+		return &admissionReview{
+			typeMeta: metav1.TypeMeta{APIVersion: admissionv1.SchemeGroupVersion.String(), Kind: "AdmissionReview"},
+			request:  review.Request,
+		}, nil
+	case admissionv1beta1.SchemeGroupVersion.String():
+		review := &admissionv1beta1.AdmissionReview{}
+		if _, _, err := deserializer.Decode(body, nil, review); err != nil {
+			return nil, err
+		}
+		decoded := &admissionReview{
+			typeMeta: metav1.TypeMeta{APIVersion: admissionv1beta1.SchemeGroupVersion.String(), Kind: "AdmissionReview"},
+		}
+		if review.Request != nil {
+			// The v1 types are field for field the same as v1beta1
+			decoded.request = &admissionv1.AdmissionRequest{}
+			if err := convert(review.Request, decoded.request); err != nil {
+				return nil, err
+			}
+		}
+		return decoded, nil
+	default:
+		return nil, fmt.Errorf("unsupported AdmissionReview version %q", typeMeta.APIVersion)
+	}
+}
+
+// encodeResponse encodes an AdmissionReview carrying response, in the same
+// version as the review that was decoded
+func (r *admissionReview) encodeResponse(response *admissionv1.AdmissionResponse) ([]byte, error) {
+	if r.typeMeta.APIVersion == admissionv1beta1.SchemeGroupVersion.String() {
+		review := &admissionv1beta1.AdmissionReview{TypeMeta: r.typeMeta, Response: &admissionv1beta1.AdmissionResponse{}}
+		if err := convert(response, review.Response); err != nil {
+			return nil, err
+		}
+		return json.Marshal(review)
+	}
+	return json.Marshal(&admissionv1.AdmissionReview{TypeMeta: r.typeMeta, Response: response})
+}
+
+// writeReviewError responds to a request that could not be handled with an
+// AdmissionReview whose response carries the error, and code as the HTTP
+// status. review is the decoded request, if any, so that the response has
+// its version and UID. The request span in ctx is marked as failed.
+func writeReviewError(ctx context.Context, w http.ResponseWriter, review *admissionReview, code int32, reason metav1.StatusReason, message string) {
+	slog.Warn("Rejected admission review", "code", code, "reason", reason, "error", message)
+	trace.SpanFromContext(ctx).SetStatus(codes.Error, message)
+	response := &admissionv1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    code,
+			Reason:  reason,
+			Message: message,
+		},
+	}
+	if review == nil {
+		review = &admissionReview{typeMeta: metav1.TypeMeta{APIVersion: admissionv1.SchemeGroupVersion.String(), Kind: "AdmissionReview"}}
+	} else if review.request != nil {
+		response.UID = review.request.UID
+	}
+	body, err := review.encodeResponse(response)
+	if err != nil {
+		http.Error(w, message, int(code))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(int(code))
+	w.Write(body) //nolint:errcheck
+}
+
+// convert copies between two types with the same JSON representation
+func convert(in, out any) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
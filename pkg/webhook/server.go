@@ -3,61 +3,196 @@ package webhook
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"strconv"
+	"sync/atomic"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/metrics"
 )
 
 // Server represents the webhook server
 type Server struct {
-	server  *http.Server
-	handler *WebhookHandler
+	server *http.Server
+	// metricsServer serves /metrics over plain HTTP, if MetricsPort is set
+	metricsServer *http.Server
+	handler       *WebhookHandler
+	certs         *certLoader
+	// certWaitTimeout is how long Start waits for the certificate
+	certWaitTimeout time.Duration
+	// certExpiryThreshold is how long before the certificate expires that
+	// the server stops being ready
+	certExpiryThreshold time.Duration
+	// draining is set once the server is shutting down
+	draining atomic.Bool
+	// clientCAFile is the CA bundle client certificates for /mutate are
+	// verified against, if any
+	clientCAFile string
+	// watchCtx is done once the server shuts down, which stops watching the
+	// certificate files
+	watchCtx  context.Context
+	stopWatch context.CancelFunc
 }
 
 // ServerConfig holds configuration for the webhook server
 type ServerConfig struct {
-	Port     int
-	CertFile string
-	KeyFile  string
+	// BindAddress is the IP address to listen on; all interfaces if empty
+	BindAddress string
+	Port        int
+	CertFile    string
+	KeyFile     string
+	// MinTLSVersion, CipherSuites and CurvePreferences are used as in
+	// tls.Config; Go's defaults apply to those that are zero
+	MinTLSVersion    uint16
+	CipherSuites     []uint16
+	CurvePreferences []tls.CurveID
+	// Timeouts of both the webhook and metrics servers, used as in
+	// http.Server
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// CertWaitTimeout is how long Start waits for CertFile and KeyFile to
+	// hold a valid certificate
+	CertWaitTimeout time.Duration
+	// CertExpiryThreshold is how long before the certificate expires that
+	// /readyz starts failing
+	CertExpiryThreshold time.Duration
+	// EnableDebug serves the effective configuration at /debug/config
+	EnableDebug bool
+	// MetricsPort serves /metrics over plain HTTP on its own port. If it is
+	// zero, /metrics is served on Port with the webhook.
+	MetricsPort int
+	// ClientCAFile makes /mutate require a client certificate signed by one
+	// of the CAs in this PEM bundle. Other endpoints do not require one.
+	ClientCAFile string
+	// AllowedClientSubjects restricts /mutate to client certificates with
+	// one of these common names. Any verified certificate is accepted if it
+	// is empty.
+	AllowedClientSubjects []string
 }
 
 // NewServer creates a new webhook server
 func NewServer(cfg ServerConfig, handler *WebhookHandler) *Server {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/mutate", handler.Handle)
+	if cfg.ClientCAFile != "" {
+		mux.Handle("/mutate", requireClientCert(cfg.AllowedClientSubjects, http.HandlerFunc(handler.Handle)))
+	} else {
+		mux.HandleFunc("/mutate", handler.Handle)
+	}
 	mux.HandleFunc("/healthz", healthzHandler)
+	if cfg.EnableDebug {
+		mux.HandleFunc("/debug/config", handler.debugConfigHandler)
+	}
 
-	return &Server{
-		server: &http.Server{
-			Addr:              fmt.Sprintf(":%d", cfg.Port),
-			Handler:           mux,
-			ReadHeaderTimeout: 10 * time.Second,
-			ReadTimeout:       30 * time.Second,
-			WriteTimeout:      30 * time.Second,
-		},
-		handler: handler,
+	s := &Server{
+		server:              newHTTPServer(cfg, cfg.Port, mux),
+		handler:             handler,
+		certs:               newCertLoader(cfg.CertFile, cfg.KeyFile),
+		certWaitTimeout:     cfg.CertWaitTimeout,
+		certExpiryThreshold: cfg.CertExpiryThreshold,
+		clientCAFile:        cfg.ClientCAFile,
+	}
+	s.server.TLSConfig = &tls.Config{
+		GetCertificate:   s.certs.GetCertificate,
+		MinVersion:       max(cfg.MinTLSVersion, tls.VersionTLS12),
+		CipherSuites:     cfg.CipherSuites,
+		CurvePreferences: cfg.CurvePreferences,
 	}
+	s.watchCtx, s.stopWatch = context.WithCancel(context.Background())
+	mux.HandleFunc("/readyz", s.readyzHandler)
+	metricsHandler := promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{})
+	if cfg.MetricsPort == 0 {
+		mux.Handle("/metrics", metricsHandler)
+	} else {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", metricsHandler)
+		s.metricsServer = newHTTPServer(cfg, cfg.MetricsPort, metricsMux)
+	}
+	return s
 }
 
-// Start starts the webhook server with TLS
-func (s *Server) Start(certFile, keyFile string) error {
-	// Load TLS certificates
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
+func newHTTPServer(cfg ServerConfig, port int, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              net.JoinHostPort(cfg.BindAddress, strconv.Itoa(port)),
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+}
+
+// Start starts the webhook server with TLS, and the metrics server if there
+// is one. It waits up to CertWaitTimeout for the certificate to be available
+// and then reloads it whenever it changes; the client CA bundle is only read
+// once. It returns when either server stops.
+func (s *Server) Start() error {
+	if err := s.certs.Wait(s.watchCtx, s.certWaitTimeout); err != nil {
 		return fmt.Errorf("failed to load TLS certificates: %w", err)
 	}
+	go func() {
+		if err := s.certs.Watch(s.watchCtx); err != nil {
+			slog.Error("TLS certificate will not be reloaded", "error", err)
+		}
+	}()
 
-	s.server.TLSConfig = &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		MinVersion:   tls.VersionTLS12,
+	if s.clientCAFile != "" {
+		pool, err := loadClientCAs(s.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to load client CA bundle: %w", err)
+		}
+		s.server.TLSConfig.ClientCAs = pool
+		s.server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	errs := make(chan error, 2)
+	if s.metricsServer != nil {
+		go func() {
+			if err := s.metricsServer.ListenAndServe(); err != nil {
+				errs <- fmt.Errorf("metrics server: %w", err)
+			}
+		}()
 	}
+	go func() {
+		errs <- s.server.ListenAndServeTLS("", "")
+	}()
+	return <-errs
+}
 
-	return s.server.ListenAndServeTLS("", "")
+// Drain prepares the server for shutdown: /readyz starts failing, so the pod
+// is removed from the Service endpoints, and connections are closed after
+// their current request, so the API server reconnects to another pod. It
+// then waits for period, or until ctx is done, while requests that were
+// already routed here keep being served.
+func (s *Server) Drain(ctx context.Context, period time.Duration) {
+	s.draining.Store(true)
+	s.server.SetKeepAlivesEnabled(false)
+	timer := time.NewTimer(period)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
 }
 
-// Shutdown gracefully shuts down the server
+// Shutdown gracefully shuts down the webhook server and then the metrics
+// server, if there is one, waiting for requests in flight to complete until
+// ctx is done. Both are shut down even if one fails.
 func (s *Server) Shutdown(ctx context.Context) error {
-	return s.server.Shutdown(ctx)
+	s.stopWatch()
+	err := s.server.Shutdown(ctx)
+	if s.metricsServer != nil {
+		err = errors.Join(err, s.metricsServer.Shutdown(ctx))
+	}
+	return err
 }
 
 // healthzHandler handles health check requests
@@ -65,3 +200,19 @@ func healthzHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK")) //nolint:errcheck
 }
+
+// debugConfigHandler serves the effective configuration, with the source of
+// every value and the compiled rules, as JSON
+func (h *WebhookHandler) debugConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := json.MarshalIndent(h.config.Effective(), "", "  ")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode configuration: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body) //nolint:errcheck
+}
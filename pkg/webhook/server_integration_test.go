@@ -98,7 +98,7 @@ var _ = Describe("Server Integration", func() {
 
 	Describe("Start", func() {
 		It("should start the server and accept HTTPS connections", func() {
-			server := NewServer(ServerConfig{Port: port}, handler)
+			server := NewServer(ServerConfig{Port: port, CertFile: certFile, KeyFile: keyFile}, handler)
 			defer func() {
 				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 				defer cancel()
@@ -108,7 +108,7 @@ var _ = Describe("Server Integration", func() {
 			// Start server in a goroutine
 			errCh := make(chan error, 1)
 			go func() {
-				errCh <- server.Start(certFile, keyFile)
+				errCh <- server.Start()
 			}()
 
 			// Give server time to start
@@ -127,7 +127,7 @@ var _ = Describe("Server Integration", func() {
 		})
 
 		It("should handle admission webhook requests", func() {
-			server := NewServer(ServerConfig{Port: port}, handler)
+			server := NewServer(ServerConfig{Port: port, CertFile: certFile, KeyFile: keyFile}, handler)
 			defer func() {
 				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 				defer cancel()
@@ -136,7 +136,7 @@ var _ = Describe("Server Integration", func() {
 
 			errCh := make(chan error, 1)
 			go func() {
-				errCh <- server.Start(certFile, keyFile)
+				errCh <- server.Start()
 			}()
 
 			time.Sleep(200 * time.Millisecond)
@@ -204,7 +204,7 @@ var _ = Describe("Server Integration", func() {
 		})
 
 		It("should reject requests with invalid method", func() {
-			server := NewServer(ServerConfig{Port: port}, handler)
+			server := NewServer(ServerConfig{Port: port, CertFile: certFile, KeyFile: keyFile}, handler)
 			defer func() {
 				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 				defer cancel()
@@ -213,7 +213,7 @@ var _ = Describe("Server Integration", func() {
 
 			errCh := make(chan error, 1)
 			go func() {
-				errCh <- server.Start(certFile, keyFile)
+				errCh <- server.Start()
 			}()
 
 			time.Sleep(200 * time.Millisecond)
@@ -229,17 +229,17 @@ var _ = Describe("Server Integration", func() {
 		})
 
 		It("should return error when certificate files are invalid", func() {
-			server := NewServer(ServerConfig{Port: port}, handler)
 			invalidCert := "/nonexistent/cert.pem"
 			invalidKey := "/nonexistent/key.pem"
+			server := NewServer(ServerConfig{Port: port, CertFile: invalidCert, KeyFile: invalidKey}, handler)
 
-			err := server.Start(invalidCert, invalidKey)
+			err := server.Start()
 			Expect(err).To(HaveOccurred())
 			Expect(err.Error()).To(ContainSubstring("failed to load TLS certificates"))
 		})
 
 		It("should return error when certificate is malformed", func() {
-			server := NewServer(ServerConfig{Port: port}, handler)
+			server := NewServer(ServerConfig{Port: port, CertFile: certFile, KeyFile: keyFile}, handler)
 
 			// replace the certFile with a malformed certificate
 			fakeCert := `-----BEGIN CERTIFICATE-----
@@ -250,24 +250,85 @@ If you try to use this as a real certificate, it will fail validation.
 			err := os.WriteFile(certFile, []byte(fakeCert), 0600)
 			Expect(err).NotTo(HaveOccurred())
 
-			err = server.Start(certFile, keyFile)
+			err = server.Start()
 			Expect(err).To(HaveOccurred())
 			Expect(err.Error()).To(ContainSubstring("failed to load TLS certificates"))
 		})
 
+		It("should wait for certificates that are not there yet", func() {
+			missingCert := filepath.Join(GinkgoT().TempDir(), "tls.crt")
+			missingKey := filepath.Join(filepath.Dir(missingCert), "tls.key")
+			server := NewServer(ServerConfig{Port: port, CertFile: missingCert, KeyFile: missingKey, CertWaitTimeout: 10 * time.Second}, handler)
+			defer func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				_ = server.Shutdown(ctx)
+			}()
+
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- server.Start()
+			}()
+
+			time.Sleep(300 * time.Millisecond)
+			Expect(os.WriteFile(missingKey, testKey, 0600)).To(Succeed())
+			Expect(os.WriteFile(missingCert, testCert, 0600)).To(Succeed())
+
+			url := fmt.Sprintf("https://localhost:%d/healthz", port)
+			Eventually(func() error {
+				resp, err := httpClient.Get(url)
+				if err == nil {
+					resp.Body.Close()
+				}
+				return err
+			}, 5*time.Second, 100*time.Millisecond).Should(Succeed())
+			Expect(errCh).NotTo(Receive())
+		})
+
+		It("should serve a renewed certificate without restarting", func() {
+			server := NewServer(ServerConfig{Port: port, CertFile: certFile, KeyFile: keyFile}, handler)
+			defer func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				_ = server.Shutdown(ctx)
+			}()
+			go func() {
+				_ = server.Start()
+			}()
+
+			servedCert := func() []byte {
+				conn, err := tls.Dial("tcp", fmt.Sprintf("localhost:%d", port), &tls.Config{
+					InsecureSkipVerify: true, //nolint:gosec
+				})
+				if err != nil {
+					return nil
+				}
+				defer conn.Close()
+				return conn.ConnectionState().PeerCertificates[0].Raw
+			}
+			Eventually(servedCert, 5*time.Second, 100*time.Millisecond).ShouldNot(BeNil())
+
+			newCert, newKey := generateTestCertificates()
+			Expect(os.WriteFile(keyFile, newKey, 0600)).To(Succeed())
+			Expect(os.WriteFile(certFile, newCert, 0600)).To(Succeed())
+
+			block, _ := pem.Decode(newCert)
+			Eventually(servedCert, 5*time.Second, 100*time.Millisecond).Should(Equal(block.Bytes))
+		})
+
 		It("should return error when port is already in use", func() {
 			// Start first server on the chosen port
-			server1 := NewServer(ServerConfig{Port: port}, handler)
+			server1 := NewServer(ServerConfig{Port: port, CertFile: certFile, KeyFile: keyFile}, handler)
 			errCh1 := make(chan error, 1)
 			go func() {
-				errCh1 <- server1.Start(certFile, keyFile)
+				errCh1 <- server1.Start()
 			}()
 
 			time.Sleep(200 * time.Millisecond)
 
 			// Try to start second server on the same port
-			server2 := NewServer(ServerConfig{Port: port}, handler)
-			err := server2.Start(certFile, keyFile)
+			server2 := NewServer(ServerConfig{Port: port, CertFile: certFile, KeyFile: keyFile}, handler)
+			err := server2.Start()
 
 			// Should get "address already in use" or similar error
 			Expect(err).To(HaveOccurred())
@@ -279,9 +340,307 @@ If you try to use this as a real certificate, it will fail validation.
 			_ = server1.Shutdown(ctx)
 		})
 	})
+
+	Describe("TLS policy and bind address", func() {
+		start := func(cfg ServerConfig) {
+			cfg.Port, cfg.CertFile, cfg.KeyFile = port, certFile, keyFile
+			server := NewServer(cfg, handler)
+			go func() {
+				_ = server.Start()
+			}()
+			DeferCleanup(func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				_ = server.Shutdown(ctx)
+			})
+		}
+
+		dial := func(host string, maxVersion uint16) (*tls.Conn, error) {
+			return tls.Dial("tcp", net.JoinHostPort(host, fmt.Sprint(port)), &tls.Config{
+				InsecureSkipVerify: true, //nolint:gosec
+				MaxVersion:         maxVersion,
+			})
+		}
+
+		It("should only accept TLS 1.3 when it is the minimum version", func() {
+			start(ServerConfig{MinTLSVersion: tls.VersionTLS13})
+			Eventually(func() error {
+				conn, err := dial("localhost", tls.VersionTLS13)
+				if err == nil {
+					conn.Close()
+				}
+				return err
+			}, 5*time.Second, 100*time.Millisecond).Should(Succeed())
+
+			_, err := dial("localhost", tls.VersionTLS12)
+			Expect(err).To(MatchError(ContainSubstring("protocol version")))
+		})
+
+		It("should only accept the configured TLS 1.2 cipher suites", func() {
+			start(ServerConfig{CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}})
+			dialWith := func(suite uint16) (*tls.Conn, error) {
+				return tls.Dial("tcp", fmt.Sprintf("localhost:%d", port), &tls.Config{
+					InsecureSkipVerify: true, //nolint:gosec
+					MaxVersion:         tls.VersionTLS12,
+					CipherSuites:       []uint16{suite},
+				})
+			}
+			Eventually(func() error {
+				conn, err := dialWith(tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256)
+				if err == nil {
+					conn.Close()
+				}
+				return err
+			}, 5*time.Second, 100*time.Millisecond).Should(Succeed())
+
+			_, err := dialWith(tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256)
+			Expect(err).To(MatchError(ContainSubstring("handshake failure")))
+		})
+
+		It("should listen on an IPv6 bind address", func() {
+			if l, err := net.Listen("tcp", "[::1]:0"); err != nil {
+				Skip("IPv6 loopback is not available")
+			} else {
+				l.Close()
+			}
+			start(ServerConfig{BindAddress: "::1"})
+			Eventually(func() error {
+				conn, err := dial("::1", 0)
+				if err == nil {
+					conn.Close()
+				}
+				return err
+			}, 5*time.Second, 100*time.Millisecond).Should(Succeed())
+
+			_, err := dial("127.0.0.1", 0)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Client certificates", func() {
+		var (
+			server *Server
+			base   string
+		)
+
+		clientFor := func(certPEM, keyPEM []byte) *http.Client {
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			Expect(err).NotTo(HaveOccurred())
+			return &http.Client{
+				Timeout: 5 * time.Second,
+				Transport: &http.Transport{
+					TLSClientConfig: &tls.Config{
+						InsecureSkipVerify: true, //nolint:gosec
+						Certificates:       []tls.Certificate{cert},
+					},
+				},
+			}
+		}
+
+		postReview := func(client *http.Client) (*http.Response, error) {
+			review, err := json.Marshal(&admissionv1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+				Request: &admissionv1.AdmissionRequest{
+					UID:       "mtls-uid",
+					Namespace: "other-namespace",
+					Operation: admissionv1.Create,
+					Object:    runtime.RawExtension{Raw: []byte(`{"metadata":{"name":"vm-1"}}`)},
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return client.Post(base+"/mutate", "application/json", bytes.NewReader(review))
+		}
+
+		var apiServerCert, apiServerKey, otherCert, otherKey []byte
+
+		BeforeEach(func() {
+			apiServerCert, apiServerKey = generateTestClientCertificate("kube-apiserver")
+			otherCert, otherKey = generateTestClientCertificate("other-client")
+			caFile := filepath.Join(GinkgoT().TempDir(), "client-ca.crt")
+			Expect(os.WriteFile(caFile, append(apiServerCert, otherCert...), 0600)).To(Succeed())
+
+			server = NewServer(ServerConfig{
+				Port:                  port,
+				CertFile:              certFile,
+				KeyFile:               keyFile,
+				ClientCAFile:          caFile,
+				AllowedClientSubjects: []string{"kube-apiserver"},
+			}, handler)
+			go func() {
+				_ = server.Start()
+			}()
+			DeferCleanup(func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				_ = server.Shutdown(ctx)
+			})
+
+			base = fmt.Sprintf("https://localhost:%d", port)
+			Eventually(func() error {
+				resp, err := httpClient.Get(base + "/healthz")
+				if err == nil {
+					resp.Body.Close()
+				}
+				return err
+			}, 5*time.Second, 100*time.Millisecond).Should(Succeed())
+		})
+
+		It("should accept an allowed client", func() {
+			resp, err := postReview(clientFor(apiServerCert, apiServerKey))
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		})
+
+		It("should reject requests without a client certificate", func() {
+			resp, err := postReview(httpClient)
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should reject a client that is not allowed", func() {
+			resp, err := postReview(clientFor(otherCert, otherKey))
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+		})
+
+		It("should reject a certificate signed by another CA", func() {
+			_, err := postReview(clientFor(generateTestClientCertificate("kube-apiserver")))
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should not require a client certificate for health checks", func() {
+			resp, err := httpClient.Get(base + "/readyz")
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		})
+	})
+
+	Describe("Drain and Shutdown", func() {
+		It("should fail readiness while draining and complete requests in flight", func() {
+			slow := &MockCPUFeatureDetector{feature: mutation.CPUFeatureVMX, delay: 500 * time.Millisecond}
+			handler = NewWebhookHandler(cfg, mutation.NewVMFeatureMutator(slow))
+			server := NewServer(ServerConfig{Port: port, CertFile: certFile, KeyFile: keyFile}, handler)
+
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- server.Start()
+			}()
+
+			base := fmt.Sprintf("https://localhost:%d", port)
+			Eventually(func() error {
+				resp, err := httpClient.Get(base + "/healthz")
+				if err == nil {
+					resp.Body.Close()
+				}
+				return err
+			}, 5*time.Second, 100*time.Millisecond).Should(Succeed())
+
+			vmBytes, err := json.Marshal(&kubevirtv1.VirtualMachine{
+				ObjectMeta: metav1.ObjectMeta{Name: "vm-slow", Namespace: "test-namespace"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			reviewBytes, err := json.Marshal(&admissionv1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+				Request: &admissionv1.AdmissionRequest{
+					UID:       "slow-uid",
+					Namespace: "test-namespace",
+					Operation: admissionv1.Create,
+					Object:    runtime.RawExtension{Raw: vmBytes},
+				},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			statusCh := make(chan int, 1)
+			go func() {
+				defer GinkgoRecover()
+				resp, err := httpClient.Post(base+"/mutate", "application/json", bytes.NewReader(reviewBytes))
+				Expect(err).NotTo(HaveOccurred())
+				resp.Body.Close()
+				statusCh <- resp.StatusCode
+			}()
+			time.Sleep(100 * time.Millisecond)
+
+			server.Drain(context.Background(), 0)
+			resp, err := httpClient.Get(base + "/readyz")
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			Expect(server.Shutdown(ctx)).To(Succeed())
+			Expect(statusCh).To(Receive(Equal(http.StatusOK)))
+			Eventually(errCh).Should(Receive(MatchError(http.ErrServerClosed)))
+		})
+
+		It("should shut down the webhook server even if the metrics server fails to", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			metricsPort := listener.Addr().(*net.TCPAddr).Port
+			listener.Close()
+			server := NewServer(ServerConfig{Port: port, CertFile: certFile, KeyFile: keyFile, MetricsPort: metricsPort}, handler)
+
+			errCh := make(chan error, 2)
+			go func() {
+				errCh <- server.Start()
+			}()
+			Eventually(func() error {
+				resp, err := httpClient.Get(fmt.Sprintf("https://localhost:%d/healthz", port))
+				if err == nil {
+					resp.Body.Close()
+				}
+				return err
+			}, 5*time.Second, 100*time.Millisecond).Should(Succeed())
+
+			// A connection that has not sent a request yet keeps the metrics
+			// server from shutting down before ctx is done
+			var conn net.Conn
+			Eventually(func() error {
+				conn, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", metricsPort))
+				return err
+			}, 5*time.Second, 100*time.Millisecond).Should(Succeed())
+			defer conn.Close()
+			time.Sleep(100 * time.Millisecond)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			Expect(server.Shutdown(ctx)).To(MatchError(context.DeadlineExceeded))
+			_, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should stop draining when the context is done", func() {
+			server := NewServer(ServerConfig{Port: port, CertFile: certFile, KeyFile: keyFile}, handler)
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			start := time.Now()
+			server.Drain(ctx, time.Minute)
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+			Expect(server.draining.Load()).To(BeTrue())
+		})
+	})
 })
 
 func generateTestCertificates() ([]byte, []byte) {
+	return generateTestCertificatesValidUntil(time.Now().Add(24 * time.Hour))
+}
+
+func generateTestCertificatesValidUntil(notAfter time.Time) ([]byte, []byte) {
+	return generateTestCertificate("test-webhook", notAfter, x509.ExtKeyUsageServerAuth)
+}
+
+// generateTestClientCertificate returns a self-signed client certificate,
+// which can be its own client CA bundle
+func generateTestClientCertificate(commonName string) ([]byte, []byte) {
+	return generateTestCertificate(commonName, time.Now().Add(24*time.Hour), x509.ExtKeyUsageClientAuth)
+}
+
+func generateTestCertificate(commonName string, notAfter time.Time, usage x509.ExtKeyUsage) ([]byte, []byte) {
 	// Generate a test RSA key
 	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
@@ -292,12 +651,12 @@ func generateTestCertificates() ([]byte, []byte) {
 	template := x509.Certificate{
 		SerialNumber: big.NewInt(1),
 		Subject: pkix.Name{
-			CommonName: "test-webhook",
+			CommonName: commonName,
 		},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(24 * time.Hour),
+		NotBefore:             notAfter.Add(-48 * time.Hour),
+		NotAfter:              notAfter,
 		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
 		BasicConstraintsValid: true,
 	}
 
@@ -1,11 +1,15 @@
 package webhook
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/config"
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/metrics"
 )
 
 var _ = Describe("Server Internal", func() {
@@ -23,4 +27,80 @@ var _ = Describe("Server Internal", func() {
 			Expect(rr.Body.String()).To(Equal("OK"))
 		})
 	})
+
+	Describe("metrics", func() {
+		scrape := func(handler http.Handler) *httptest.ResponseRecorder {
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+			return rr
+		}
+
+		It("should be served with the webhook by default", func() {
+			server := NewServer(ServerConfig{Port: 8443}, NewWebhookHandler(&config.Config{}, nil))
+			Expect(server.metricsServer).To(BeNil())
+
+			rr := scrape(server.server.Handler)
+			Expect(rr.Code).To(Equal(http.StatusOK))
+			Expect(rr.Body.String()).To(ContainSubstring("nested_virt_patch_verification_failures_total"))
+		})
+
+		It("should report the last good configuration load", func() {
+			metrics.RecordConfigLoad(nil)
+			server := NewServer(ServerConfig{Port: 8443}, NewWebhookHandler(&config.Config{}, nil))
+
+			body := scrape(server.server.Handler).Body.String()
+			Expect(body).To(ContainSubstring(`nested_virt_config_loads_total{result="success"}`))
+			Expect(body).To(ContainSubstring("nested_virt_config_last_success_timestamp_seconds"))
+		})
+
+		It("should be served on its own port when one is set", func() {
+			server := NewServer(ServerConfig{Port: 8443, MetricsPort: 8080}, NewWebhookHandler(&config.Config{}, nil))
+			Expect(server.metricsServer).NotTo(BeNil())
+			Expect(server.metricsServer.Addr).To(Equal(":8080"))
+
+			Expect(scrape(server.server.Handler).Code).To(Equal(http.StatusNotFound))
+			rr := scrape(server.metricsServer.Handler)
+			Expect(rr.Code).To(Equal(http.StatusOK))
+			Expect(rr.Body.String()).To(ContainSubstring("nested_virt_detector_errors_total"))
+		})
+	})
+
+	Describe("debugConfigHandler", func() {
+		var handler *WebhookHandler
+
+		BeforeEach(func() {
+			cfg := config.ApplyDefaults(&config.Config{
+				Rules: []config.NamespaceRuleConfig{{Namespace: "dev", Patterns: []string{"^vm-.*"}}},
+			})
+			handler = NewWebhookHandler(cfg, nil)
+		})
+
+		It("should return the effective configuration as JSON", func() {
+			req, err := http.NewRequest("GET", "/debug/config", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			handler.debugConfigHandler(rr, req)
+
+			Expect(rr.Code).To(Equal(http.StatusOK))
+			Expect(rr.Header().Get("Content-Type")).To(Equal("application/json"))
+
+			var eff config.EffectiveConfig
+			Expect(json.Unmarshal(rr.Body.Bytes(), &eff)).To(Succeed())
+			Expect(eff.Values["port"].Value).To(BeEquivalentTo(config.DefaultPort))
+			Expect(eff.Values["port"].Source.Kind).To(Equal(config.SourceDefault))
+			Expect(eff.Values["drain-period"].Value).To(Equal(config.DefaultDrainPeriod.String()))
+			Expect(eff.Rules).To(Equal([]config.CompiledRule{{Name: "rules[0]", Namespace: "dev", Patterns: []string{"^vm-.*"}, OnError: config.OnErrorAllow, Mode: config.ModeEnforce}}))
+		})
+
+		It("should reject methods other than GET", func() {
+			req, err := http.NewRequest("POST", "/debug/config", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			rr := httptest.NewRecorder()
+			handler.debugConfigHandler(rr, req)
+
+			Expect(rr.Code).To(Equal(http.StatusMethodNotAllowed))
+		})
+	})
 })
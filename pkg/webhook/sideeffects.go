@@ -0,0 +1,36 @@
+package webhook
+
+import (
+	"context"
+	"log/slog"
+
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// sideEffect is something done for a request beyond building its response,
+// such as recording the decision in another system. It must not change the
+// response.
+type sideEffect struct {
+	name string
+	run  func(ctx context.Context, req *admissionv1.AdmissionRequest, response *admissionv1.AdmissionResponse) error
+}
+
+// runSideEffects runs the handler's side effects for req once its response
+// is known, unless req is a dry run. Every side effect must go through here:
+// the API server only sends dry-run requests to webhooks registered with
+// sideEffects None or NoneOnDryRun, and promises callers that a dry run
+// changes nothing. Failures are logged to log; the response stands.
+func (h *WebhookHandler) runSideEffects(ctx context.Context, log *slog.Logger, req *admissionv1.AdmissionRequest, response *admissionv1.AdmissionResponse, dryRun bool) {
+	if len(h.sideEffects) == 0 {
+		return
+	}
+	if dryRun {
+		log.Debug("Skipping side effects for dry-run request", "namespace", req.Namespace, "name", req.Name)
+		return
+	}
+	for _, effect := range h.sideEffects {
+		if err := effect.run(ctx, req, response); err != nil {
+			log.Warn("Side effect failed", "sideEffect", effect.name, "namespace", req.Namespace, "name", req.Name, "error", err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package webhook
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/config"
+)
+
+const (
+	// warningPrefix starts every warning so users can tell where it came from
+	warningPrefix = "nested-virt: "
+	// shadowPrefix follows warningPrefix in shadow mode, since the warning
+	// describes something that was not done
+	shadowPrefix = "[shadow] "
+	// maxWarningLength is the longest warning returned, in bytes. The API
+	// server may truncate warnings longer than 256 characters.
+	maxWarningLength = 256
+)
+
+// warnings returns the admission warnings for event, expanded from the
+// configured template, or nil if the warning is turned off
+func (h *WebhookHandler) warnings(event string, vars map[string]string) []string {
+	template := h.config.Warning(event)
+	if template == "" {
+		return nil
+	}
+	msg := config.ExpandWarning(template, vars)
+	if vars["mode"] == config.ModeShadow {
+		msg = shadowPrefix + msg
+	}
+	return []string{formatWarning(msg)}
+}
+
+// formatWarning prefixes msg and makes it safe to return as a warning: a
+// single line of printable characters no longer than maxWarningLength
+func formatWarning(msg string) string {
+	msg = warningPrefix + strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, msg)
+	if len(msg) <= maxWarningLength {
+		return msg
+	}
+
+	const ellipsis = "..."
+	end := maxWarningLength - len(ellipsis)
+	for end > 0 && !utf8.RuneStart(msg[end]) {
+		end--
+	}
+	return msg[:end] + ellipsis
+}
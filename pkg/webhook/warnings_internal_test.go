@@ -0,0 +1,46 @@
+package webhook
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/jaevans/harvester-enable-nested-virt/pkg/config"
+)
+
+var _ = Describe("Warnings", func() {
+	Describe("formatWarning", func() {
+		It("should prefix the message", func() {
+			Expect(formatWarning("added cpu feature vmx (rule dev-all)")).To(
+				Equal("nested-virt: added cpu feature vmx (rule dev-all)"))
+		})
+
+		It("should keep the warning on one line", func() {
+			Expect(formatWarning("bad\nthings\thappened")).To(Equal("nested-virt: bad things happened"))
+		})
+
+		It("should cap the length without splitting characters", func() {
+			warning := formatWarning(strings.Repeat("é", 200))
+			Expect(len(warning)).To(BeNumerically("<=", maxWarningLength))
+			Expect(utf8.ValidString(warning)).To(BeTrue())
+			Expect(warning).To(HaveSuffix("..."))
+		})
+	})
+
+	Describe("warnings", func() {
+		It("should return nothing for warnings that are turned off", func() {
+			h := NewWebhookHandler(&config.Config{}, nil)
+			Expect(h.warnings(config.WarnSkip, nil)).To(BeNil())
+		})
+
+		It("should expand the configured template", func() {
+			msg := "{name} in {namespace} skipped: {reason}"
+			h := NewWebhookHandler(&config.Config{Warnings: &config.WarningsConfig{Skip: &msg}}, nil)
+			Expect(h.warnings(config.WarnSkip, map[string]string{
+				"name": "vm-1", "namespace": "dev", "reason": "no rule matches",
+			})).To(Equal([]string{"nested-virt: vm-1 in dev skipped: no rule matches"}))
+		})
+	})
+})